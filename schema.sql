@@ -1,15 +0,0 @@
-CREATE TABLE item (
-	guid       TEXT NOT NULL PRIMARY KEY,
-	judgement  BOOLEAN NULL,
-	score      FLOAT NOT NULL,
-	feed       TEXT NOT NULL,
-	title      TEXT NOT NULL,
-	link       TEXT NOT NULL,
-	INDEX judgement_idx (judgement),
-	INDEX score_idx (score)
-);
-
-CREATE TABLE feed (
-	name  TEXT NOT NULL,
-	link  TEXT NOT NULL
-);
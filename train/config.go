@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// config is everything the trainer can be configured with.  As in the www
+// server, the TOML file named by -config or the config environment variable
+// overrides the defaults, environment variables override the file, and flags
+// override everything.
+type config struct {
+	Database string `toml:"database"`
+	Listen   string `toml:"listen"`
+
+	// Judgements of items shown in exploration slots are the only ones not
+	// skewed by what the current model already likes, so they count extra.
+	// An explore_weight of 0 leaves them out instead.
+	ExploreWeight int `toml:"explore_weight"`
+
+	FastText          string `toml:"fasttext"`
+	PretrainedVectors string `toml:"pretrained_vectors"`
+
+	// The trainer reads every judgement, so it has to be protected by a
+	// shared secret, which the www server sends as trainer.secret, or by
+	// requiring client certificates signed by tls_client_ca, or both.
+	Secret      string `toml:"secret"`
+	TLSCert     string `toml:"tls_cert"`
+	TLSKey      string `toml:"tls_key"`
+	TLSClientCA string `toml:"tls_client_ca"`
+}
+
+func defaultConfig() config {
+	return config{
+		Database:          "postgresql://localhost:26257/feed?sslmode=disable",
+		ExploreWeight:     2,
+		FastText:          "fasttext",
+		PretrainedVectors: "wiki-news-300d-1M.vec",
+	}
+}
+
+// loadConfig builds the configuration from args and the environment, and
+// checks it.
+func loadConfig(args []string) (config, error) {
+	c := defaultConfig()
+
+	flags := flag.NewFlagSet("train", flag.ContinueOnError)
+	path := flags.String("config", os.Getenv("config"), "TOML configuration `file`")
+	database := flags.String("database", "", "database connection `URL`")
+	listen := flags.String("listen", "", "`address` to serve on")
+	if err := flags.Parse(args); err != nil {
+		return c, err
+	}
+
+	if *path != "" {
+		if _, err := toml.DecodeFile(*path, &c); err != nil {
+			return c, fmt.Errorf("Reading %s: %s", *path, err)
+		}
+	}
+
+	for name, v := range map[string]*string{
+		"database_url":       &c.Database,
+		"listen_address":     &c.Listen,
+		"fasttext":           &c.FastText,
+		"pretrained_vectors": &c.PretrainedVectors,
+		"train_secret":       &c.Secret,
+		"tls_cert":           &c.TLSCert,
+		"tls_key":            &c.TLSKey,
+		"tls_client_ca":      &c.TLSClientCA,
+	} {
+		if s := os.Getenv(name); s != "" {
+			*v = s
+		}
+	}
+
+	if s := os.Getenv("explore_weight"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return c, fmt.Errorf("Parsing explore_weight: %q is not a whole number", s)
+		}
+		c.ExploreWeight = n
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "database":
+			c.Database = *database
+		case "listen":
+			c.Listen = *listen
+		}
+	})
+
+	return c, c.validate()
+}
+
+func (c *config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Database != "", "database must be set")
+	check(c.ExploreWeight >= 0, "explore_weight must not be negative, not %d", c.ExploreWeight)
+	check(c.FastText != "" && c.PretrainedVectors != "", "fasttext and pretrained_vectors must be set")
+	check(c.Secret != "" || c.TLSClientCA != "", "either secret or tls_client_ca must be set")
+	check(c.TLSClientCA == "" || (c.TLSCert != "" && c.TLSKey != ""), "tls_client_ca needs tls_cert and tls_key")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid configuration:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
@@ -1,22 +1,30 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	_ "github.com/lib/pq"
 	"io/ioutil"
 	"log"
+	_ "modernc.org/sqlite"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
 func main() {
-	db, err := sql.Open("postgres", "postgresql://localhost:26257/feed?sslmode=disable")
+	cfg, err := loadConfig(os.Args[1:])
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+
+	db, err := openDatabase(cfg.Database)
+	if err != nil {
+		log.Fatalf("Opening database: %s", err)
 	}
 	defer db.Close()
 
@@ -25,27 +33,82 @@ func main() {
 	})
 
 	http.HandleFunc("/train", func(w http.ResponseWriter, r *http.Request) {
-		result, err := train(db)
+		result, err := train(db, cfg)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		if err := json.NewEncoder(w).Encode(result); err != nil {
-			panic(err)
+			log.Printf("Writing training result: %s", err)
 		}
 	})
 
-	listenAddress := os.Getenv("listen_address")
-	log.Printf("Listening on %q", listenAddress)
-	panic(http.ListenAndServe(listenAddress, nil))
+	var handler http.Handler = http.DefaultServeMux
+	if cfg.Secret != "" {
+		handler = requireSecret(cfg.Secret, handler)
+	}
+
+	server := &http.Server{
+		Addr:    cfg.Listen,
+		Handler: handler,
+	}
+
+	if cfg.TLSClientCA != "" {
+		server.TLSConfig, err = clientCATLSConfig(cfg.TLSClientCA)
+		if err != nil {
+			log.Fatalf("Loading tls_client_ca: %s", err)
+		}
+
+		log.Printf("Listening with TLS on %q", server.Addr)
+		log.Fatal(server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey))
+	}
+
+	log.Printf("Listening on %q", server.Addr)
+	log.Fatal(server.ListenAndServe())
+}
+
+// Number of words of article text appended to an item's features; must match
+// articleFeatureWords in the www server's classifier.
+const articleFeatureWords = 100
+
+// userFeatures adds a copy of every word in features marked with the
+// account, so that one model learns both what everyone likes and what each
+// account likes in particular.  Must match userFeatures in the www server.
+func userFeatures(account int64, features string) string {
+	words := strings.Fields(features)
+	marked := make([]string, len(words))
+	for i, word := range words {
+		marked[i] = fmt.Sprintf("u%d_%s", account, word)
+	}
+	return features + " " + strings.Join(marked, " ")
+}
+
+// How many times an item's line is repeated in the training data, by the
+// action that judged it.  Explicit judgements say more than implicit ones;
+// items judged before actions were recorded have no action and count once.
+var actionWeights = map[string]int{
+	"click":          2,
+	"skip":           1,
+	"not_interested": 2,
+	"love":           4,
 }
 
 type trainResult struct {
 	Bin, Vec []byte
 }
 
-func train(db *sql.DB) (*trainResult, error) {
+// openDatabase opens the www server's database, named as in its
+// configuration: a PostgreSQL connection URL, or sqlite: followed by the path
+// of an SQLite database file.  The trainer only reads it.
+func openDatabase(database string) (*sql.DB, error) {
+	if path := strings.TrimPrefix(database, "sqlite:"); path != database {
+		return sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=busy_timeout(10000)")
+	}
+	return sql.Open("postgres", database)
+}
+
+func train(db *sql.DB, cfg config) (*trainResult, error) {
 	tempDir, err := ioutil.TempDir("", "train")
 	if err != nil {
 		return nil, fmt.Errorf("Creating temporary directory for training: %s", err)
@@ -74,9 +137,11 @@ func train(db *sql.DB) (*trainResult, error) {
 
 	{
 		rows, err := db.Query(`
-			SELECT judgement, feed, title
-			FROM item
-			WHERE judgement IS NOT NULL
+			SELECT user_item.account, user_item.judgement, COALESCE(user_item.action, ''), user_item.explored, item.feed, item.title, COALESCE(article.text, '')
+			FROM user_item
+			JOIN item ON item.guid = user_item.guid
+			LEFT JOIN article ON article.guid = item.guid
+			WHERE user_item.judgement IS NOT NULL
 		`)
 		if err != nil {
 			return nil, err
@@ -86,18 +151,40 @@ func train(db *sql.DB) (*trainResult, error) {
 		i := 0
 
 		for rows.Next() {
-			var judgement bool
-			var feed, title string
-			if err := rows.Scan(&judgement, &feed, &title); err != nil {
+			var account int64
+			var judgement, explored bool
+			var action, feed, title, text string
+			if err := rows.Scan(&account, &judgement, &action, &explored, &feed, &title, &text); err != nil {
 				return nil, err
 			}
 
+			features := fmt.Sprintf("%s %s", feed, title)
+			if words := strings.Fields(text); len(words) > 0 {
+				if len(words) > articleFeatureWords {
+					words = words[:articleFeatureWords]
+				}
+				features += " " + strings.Join(words, " ")
+			}
+			features = userFeatures(account, features)
+
 			var line []byte
 			if judgement {
-				line = []byte(fmt.Sprintf("__label__1 %s %s\n", feed, title))
+				line = []byte(fmt.Sprintf("__label__1 %s\n", features))
 			} else {
-				line = []byte(fmt.Sprintf("__label__0 %s %s\n", feed, title))
+				line = []byte(fmt.Sprintf("__label__0 %s\n", features))
+			}
+
+			// fastText has no sample weights, so weightier judgements are
+			// repeated instead.  Every copy goes to the same side of the
+			// train/test split.
+			weight, ok := actionWeights[action]
+			if !ok {
+				weight = 1
+			}
+			if explored {
+				weight *= cfg.ExploreWeight
 			}
+			line = bytes.Repeat(line, weight)
 
 			if _, err := dataFile.Write(line); err != nil {
 				return nil, err
@@ -135,12 +222,12 @@ func train(db *sql.DB) (*trainResult, error) {
 
 	log.Printf("Training: Done collecting data into files")
 
-	pretrainedVectorsPath, err := filepath.Abs("wiki-news-300d-1M.vec")
+	pretrainedVectorsPath, err := filepath.Abs(cfg.PretrainedVectors)
 	if err != nil {
 		return nil, err
 	}
 
-	fastTextPath, err := filepath.Abs("fasttext")
+	fastTextPath, err := filepath.Abs(cfg.FastText)
 	if err != nil {
 		return nil, err
 	}
@@ -171,7 +258,7 @@ func train(db *sql.DB) (*trainResult, error) {
 		log.Printf("Training: testing test model")
 		cmd := exec.Command(
 			"/usr/bin/time", "-v",
-			"fasttext", "test", "test-model.bin", "test-data",
+			fastTextPath, "test", "test-model.bin", "test-data",
 		)
 		cmd.Stdout = os.Stderr
 		cmd.Stderr = os.Stderr
@@ -184,7 +271,7 @@ func train(db *sql.DB) (*trainResult, error) {
 		log.Printf("Training: training real model")
 		cmd := exec.Command(
 			"/usr/bin/time", "-v",
-			"fasttext", "supervised",
+			fastTextPath, "supervised",
 			"-input", "data",
 			"-output", "model",
 			"-epoch", "20",
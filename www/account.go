@@ -0,0 +1,766 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// account is a reader of the shared feeds, with their own subscriptions,
+// judgements and scores.
+type account struct {
+	ID    int64
+	Name  string
+	Email string
+
+	// FeedToken authenticates the account's output feeds and event stream,
+	// which are read by programs that cannot log in.
+	FeedToken string
+}
+
+const (
+	sessionCookie   = "session"
+	sessionLifetime = 30 * 24 * time.Hour
+
+	// How long a failed login waits before answering.
+	failedLoginDelay = time.Second
+
+	// How far back a new subscription fills in items from its feed.
+	subscriptionBackfill = 7 * 24 * time.Hour
+)
+
+var (
+	errBadLogin  = errors.New("Unknown account or wrong password")
+	errTokenName = errors.New("Tokens need a name")
+)
+
+func randomToken() string {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// hashToken is how session tokens are stored, so that the session table
+// cannot be used to log in.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *sqlStore) countAccounts() (int, error) {
+	var n int
+	err := s.db.QueryRow(`
+		SELECT count(*)
+		FROM account
+	`).Scan(&n)
+	return n, err
+}
+
+// createAccount adds an account subscribed to every feed.  The first
+// account also adopts the judgements made before there were accounts.
+func createAccount(st Store, classifier *classifier, name, password, email string) (account, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(password) < 8 {
+		return account{}, fmt.Errorf("Accounts need a name and a password of at least 8 characters")
+	}
+
+	// Digests are sent to the address as it is, so it must be a bare
+	// address, with nothing else to put in the To header.
+	email = strings.TrimSpace(email)
+	if email != "" {
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Name != "" || addr.Address != email {
+			return account{}, fmt.Errorf("%q is not an email address", email)
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return account{}, err
+	}
+
+	a, err := st.insertAccount(account{Name: name, Email: email, FeedToken: randomToken()}, string(hash))
+	if err != nil {
+		return account{}, err
+	}
+
+	log.Printf("Created account %q", a.Name)
+
+	feeds, err := st.listSubscriptions(a.ID)
+	if err != nil {
+		return a, err
+	}
+
+	for _, feed := range feeds {
+		if err := subscribe(st, classifier, a.ID, feed.Name); err != nil {
+			return a, err
+		}
+	}
+
+	return a, nil
+}
+
+// insertAccount adds a with the given password hash and returns it with its
+// ID.  The first account adopts the judgements made before there were
+// accounts.
+func (s *sqlStore) insertAccount(a account, passwordHash string) (account, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return account{}, err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	if err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM account WHERE name = $1)
+	`, a.Name).Scan(&taken); err != nil {
+		return account{}, err
+	} else if taken {
+		return account{}, fmt.Errorf("The name %q is taken", a.Name)
+	}
+
+	var first bool
+	if err := tx.QueryRow(`
+		SELECT NOT EXISTS (SELECT 1 FROM account)
+	`).Scan(&first); err != nil {
+		return account{}, err
+	}
+
+	if err := tx.QueryRow(`
+		INSERT INTO account (name, password_hash, email, feed_token, created)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, a.Name, passwordHash, a.Email, a.FeedToken, time.Now().UTC()).Scan(&a.ID); err != nil {
+		return account{}, err
+	}
+
+	if first {
+		if err := adoptLegacy(tx, a.ID); err != nil {
+			return account{}, err
+		}
+	}
+
+	return a, tx.Commit()
+}
+
+// adoptLegacy gives account the judgements, scores and history recorded
+// when the server had a single reader, which live in the item table and
+// under account 0.
+func adoptLegacy(tx *sql.Tx, accountID int64) error {
+	if _, err := tx.Exec(`
+		INSERT INTO user_item (account, guid, judgement, action, score, explored)
+		SELECT $1, guid, judgement, action, score, explored
+		FROM item
+	`, accountID); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"judgement_event", "impression", "digest", "digest_item"} {
+		if _, err := tx.Exec(`
+			UPDATE `+table+`
+			SET account = $1
+			WHERE account = 0
+		`, accountID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// authenticate returns the account with the given name and password, or
+// errBadLogin.
+func authenticate(st Store, name, password string) (account, error) {
+	a, hash, err := st.accountByName(strings.TrimSpace(name))
+	if err == sql.ErrNoRows {
+		return account{}, errBadLogin
+	} else if err != nil {
+		return account{}, err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return account{}, errBadLogin
+	}
+
+	return a, nil
+}
+
+// accountByName returns the account with the given name and its password
+// hash, or sql.ErrNoRows.
+func (s *sqlStore) accountByName(name string) (account, string, error) {
+	var a account
+	var hash string
+	err := s.db.QueryRow(`
+		SELECT id, name, email, feed_token, password_hash
+		FROM account
+		WHERE name = $1
+	`, name).Scan(&a.ID, &a.Name, &a.Email, &a.FeedToken, &hash)
+	return a, hash, err
+}
+
+// startSession logs a in on the client with a new session cookie, which is
+// only sent over HTTPS if secure is set.
+func startSession(st Store, w http.ResponseWriter, a account, secure bool) error {
+	token := randomToken()
+	now := time.Now()
+
+	if err := st.addSession(hashToken(token), a.ID, now, now.Add(sessionLifetime)); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  now.Add(sessionLifetime),
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// endSession logs the client out.
+func endSession(st Store, w http.ResponseWriter, r *http.Request, secure bool) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+
+	return st.deleteSession(hashToken(cookie.Value))
+}
+
+func (s *sqlStore) addSession(tokenHash string, accountID int64, created, expires time.Time) error {
+	_, err := s.db.Exec(`
+		INSERT INTO session (token, account, created, expires)
+		VALUES ($1, $2, $3, $4)
+	`, tokenHash, accountID, created.UTC(), expires.UTC())
+	return err
+}
+
+func (s *sqlStore) deleteSession(tokenHash string) error {
+	_, err := s.db.Exec(`
+		DELETE FROM session
+		WHERE token = $1
+	`, tokenHash)
+	return err
+}
+
+// sessionAccount returns the account logged in by the request's session
+// cookie, or false if there is none.
+func sessionAccount(st Store, r *http.Request) (account, bool, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return account{}, false, nil
+	}
+
+	return st.accountBySession(hashToken(cookie.Value), time.Now())
+}
+
+// accountBySession returns the account whose session has the given token
+// hash and has not expired by now, or false if there is none.
+func (s *sqlStore) accountBySession(tokenHash string, now time.Time) (account, bool, error) {
+	var a account
+	err := s.db.QueryRow(`
+		SELECT account.id, account.name, account.email, account.feed_token
+		FROM session
+		JOIN account ON account.id = session.account
+		WHERE session.token = $1 AND session.expires > $2
+	`, tokenHash, now.UTC()).Scan(&a.ID, &a.Name, &a.Email, &a.FeedToken)
+	if err == sql.ErrNoRows {
+		return account{}, false, nil
+	} else if err != nil {
+		return account{}, false, err
+	}
+
+	return a, true, nil
+}
+
+// accountByFeedToken returns the account whose feed token is token, or false
+// if there is none.
+func (s *sqlStore) accountByFeedToken(token string) (account, bool, error) {
+	if token == "" {
+		return account{}, false, nil
+	}
+
+	var a account
+	err := s.db.QueryRow(`
+		SELECT id, name, email, feed_token
+		FROM account
+		WHERE feed_token = $1
+	`, token).Scan(&a.ID, &a.Name, &a.Email, &a.FeedToken)
+	if err == sql.ErrNoRows {
+		return account{}, false, nil
+	} else if err != nil {
+		return account{}, false, err
+	}
+
+	return a, true, nil
+}
+
+// accountByID returns the account with the given ID, or false if there is
+// none.
+func (s *sqlStore) accountByID(id int64) (account, bool, error) {
+	var a account
+	err := s.db.QueryRow(`
+		SELECT id, name, email, feed_token
+		FROM account
+		WHERE id = $1
+	`, id).Scan(&a.ID, &a.Name, &a.Email, &a.FeedToken)
+	if err == sql.ErrNoRows {
+		return account{}, false, nil
+	} else if err != nil {
+		return account{}, false, err
+	}
+
+	return a, true, nil
+}
+
+// accounts returns every account.
+func (s *sqlStore) accounts() ([]account, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, email, feed_token
+		FROM account
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []account
+	for rows.Next() {
+		var a account
+		if err := rows.Scan(&a.ID, &a.Name, &a.Email, &a.FeedToken); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+
+	return accounts, rows.Err()
+}
+
+// accountsWithEmail returns every account with an email address.
+func (s *sqlStore) accountsWithEmail() ([]account, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, email, feed_token
+		FROM account
+		WHERE email <> ''
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []account
+	for rows.Next() {
+		var a account
+		if err := rows.Scan(&a.ID, &a.Name, &a.Email, &a.FeedToken); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+
+	return accounts, rows.Err()
+}
+
+// apiToken is a named secret an account can log in with instead of its
+// password, meant for scripts and the API.
+type apiToken struct {
+	ID       int64
+	Name     string
+	Created  time.Time
+	LastUsed sql.NullTime
+}
+
+// createToken adds a token named name to the account and returns it.  Only
+// its hash is kept, so it cannot be shown again.
+func createToken(st Store, accountID int64, name string) (apiToken, string, error) {
+	t := apiToken{Name: strings.TrimSpace(name), Created: time.Now()}
+	if t.Name == "" {
+		return apiToken{}, "", errTokenName
+	}
+
+	token := randomToken()
+	id, err := st.addToken(accountID, t.Name, hashToken(token), t.Created)
+	if err != nil {
+		return apiToken{}, "", err
+	}
+	t.ID = id
+
+	return t, token, nil
+}
+
+func (s *sqlStore) addToken(accountID int64, name, hash string, created time.Time) (int64, error) {
+	var id int64
+	err := s.db.QueryRow(`
+		INSERT INTO api_token (account, name, hash, created)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, accountID, name, hash, created.UTC()).Scan(&id)
+	return id, err
+}
+
+// listTokens returns the account's tokens, newest first.
+func (s *sqlStore) listTokens(accountID int64) ([]apiToken, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, created, last_used
+		FROM api_token
+		WHERE account = $1
+		ORDER BY created DESC
+	`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]apiToken, 0)
+	for rows.Next() {
+		var t apiToken
+		if err := rows.Scan(&t.ID, &t.Name, &t.Created, &t.LastUsed); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// revokeToken deletes the account's token with the given ID, returning
+// false if it has none.
+func (s *sqlStore) revokeToken(accountID, id int64) (bool, error) {
+	result, err := s.db.Exec(`
+		DELETE FROM api_token
+		WHERE account = $1 AND id = $2
+	`, accountID, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// apiTokenAccount returns the account token belongs to, or false if it is
+// not a token.
+func apiTokenAccount(st Store, token string) (account, bool, error) {
+	if token == "" {
+		return account{}, false, nil
+	}
+
+	return st.accountByToken(hashToken(token), time.Now())
+}
+
+// accountByToken returns the account owning the API token with the given
+// hash, recording that it was used, or false if there is no such token.
+func (s *sqlStore) accountByToken(hash string, used time.Time) (account, bool, error) {
+	var a account
+	var id int64
+	err := s.db.QueryRow(`
+		SELECT api_token.id, account.id, account.name, account.email, account.feed_token
+		FROM api_token
+		JOIN account ON account.id = api_token.account
+		WHERE api_token.hash = $1
+	`, hash).Scan(&id, &a.ID, &a.Name, &a.Email, &a.FeedToken)
+	if err == sql.ErrNoRows {
+		return account{}, false, nil
+	} else if err != nil {
+		return account{}, false, err
+	}
+
+	if _, err := s.db.Exec(`
+		UPDATE api_token
+		SET last_used = $1
+		WHERE id = $2
+	`, used.UTC(), id); err != nil {
+		log.Printf("Recording use of token %d: %s", id, err)
+	}
+
+	return a, true, nil
+}
+
+// bearerToken returns the token in the request's Authorization header, or
+// "" if there is none.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+type contextKey int
+
+const accountKey contextKey = 0
+
+// accountFrom returns the account the request was authenticated as by
+// requireAccount.
+func accountFrom(r *http.Request) account {
+	return r.Context().Value(accountKey).(account)
+}
+
+// Paths anyone may request, though with a session's CSRF token if they have
+// one.  Links to /click are signed for the account whose click they record,
+// so that they work from feed readers and email as well.
+var publicPaths = map[string]bool{
+	"/login":  true,
+	"/signup": true,
+	"/logout": true,
+	"/click":  true,
+}
+
+// Paths read by feed readers and notifiers, which authenticate with the
+// account's feed token in the token query parameter instead of a session.
+var tokenPaths = map[string]bool{
+	"/out/atom.xml": true,
+	"/out/rss.xml":  true,
+	"/events":       true,
+}
+
+// requireAccount passes requests on to next with the account they are
+// authenticated as, by an API token in the Authorization header or else by
+// session cookie, and sends everyone else to log in.  Session requests that
+// change anything must also carry the session's CSRF token.  Errors looking
+// up the account are shown on pages.
+func requireAccount(st Store, pages *errorPage, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			// Logging out ends a session, so it is as forgeable as anything a
+			// session does: whoever has one must show its token here too.
+			if _, ok, err := sessionAccount(st, r); err != nil {
+				pages.serve(w, r, err)
+				return
+			} else if ok && !checkCSRF(r) {
+				pages.serve(w, r, clientError(http.StatusForbidden, "Missing or invalid CSRF token"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if token := bearerToken(r); token != "" {
+			a, ok, err := apiTokenAccount(st, token)
+			if err != nil {
+				pages.serve(w, r, err)
+				return
+			} else if !ok {
+				writeError(w, http.StatusUnauthorized, "Unknown token")
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accountKey, a)))
+			return
+		}
+
+		a, ok, err := sessionAccount(st, r)
+		if err != nil {
+			pages.serve(w, r, err)
+			return
+		}
+
+		if ok && !checkCSRF(r) {
+			pages.serve(w, r, clientError(http.StatusForbidden, "Missing or invalid CSRF token"))
+			return
+		}
+
+		if !ok && tokenPaths[r.URL.Path] {
+			a, ok, err = st.accountByFeedToken(r.URL.Query().Get("token"))
+			if err != nil {
+				pages.serve(w, r, err)
+				return
+			}
+		}
+
+		if !ok {
+			if strings.HasPrefix(r.URL.Path, "/api/") || tokenPaths[r.URL.Path] {
+				writeError(w, http.StatusUnauthorized, "Not logged in")
+			} else {
+				http.Redirect(w, r, "/login", http.StatusFound)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accountKey, a)))
+	})
+}
+
+// subscribe subscribes the account to feed and gives it the feed's recent
+// items, scored for it.
+func subscribe(st Store, classifier *classifier, accountID int64, feed string) error {
+	if err := st.addSubscription(accountID, feed); err != nil {
+		return err
+	}
+
+	items, err := st.feedItemsSince(feed, time.Now().Add(-subscriptionBackfill))
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := st.addUserItem(accountID, item, classifier.classify(classifiableString(accountID, item))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlStore) addSubscription(accountID int64, feed string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO subscription (account, feed)
+		VALUES ($1, $2)
+		ON CONFLICT (account, feed) DO NOTHING
+	`, accountID, feed)
+	return err
+}
+
+// feedItemsSince returns the items of feed published after since, with
+// their article text.
+func (s *sqlStore) feedItemsSince(feed string, since time.Time) ([]feedItem, error) {
+	rows, err := s.db.Query(`
+		SELECT item.guid, item.feed, item.title, COALESCE(article.text, '')
+		FROM item
+		LEFT JOIN article ON article.guid = item.guid
+		WHERE item.feed = $1 AND item.published > $2
+	`, feed, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []feedItem
+	for rows.Next() {
+		var item feedItem
+		if err := rows.Scan(&item.GUID, &item.Feed, &item.Title, &item.Text); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// unsubscribe unsubscribes the account from feed, dropping the feed's items
+// it has not judged.
+func (s *sqlStore) unsubscribe(accountID int64, feed string) error {
+	if _, err := s.db.Exec(`
+		DELETE FROM subscription
+		WHERE account = $1 AND feed = $2
+	`, accountID, feed); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(`
+		DELETE FROM user_item
+		WHERE account = $1 AND judgement IS NULL AND action IS NULL AND guid IN (
+			SELECT guid
+			FROM item
+			WHERE feed = $2
+		)
+	`, accountID, feed)
+	return err
+}
+
+// subscribers returns the accounts subscribed to feed.
+func (s *sqlStore) subscribers(feed string) ([]int64, error) {
+	rows, err := s.db.Query(`
+		SELECT account
+		FROM subscription
+		WHERE feed = $1
+	`, feed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, id)
+	}
+
+	return accounts, rows.Err()
+}
+
+// addUserItem offers item to the account with the given score, unless it
+// already has been.
+func (s *sqlStore) addUserItem(accountID int64, item feedItem, score float64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO user_item (account, guid, score)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (account, guid) DO NOTHING
+	`, accountID, item.GUID, score)
+	return err
+}
+
+type subscriptionRow struct {
+	Name       string
+	Link       string
+	Subscribed bool
+}
+
+// listSubscriptions returns every feed, marking those the account is
+// subscribed to.
+func (s *sqlStore) listSubscriptions(accountID int64) ([]subscriptionRow, error) {
+	rows, err := s.db.Query(`
+		SELECT feed.name, feed.link, subscription.feed IS NOT NULL
+		FROM feed
+		LEFT JOIN subscription ON subscription.feed = feed.name AND subscription.account = $1
+		ORDER BY feed.name
+	`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feeds := make([]subscriptionRow, 0)
+	for rows.Next() {
+		var feed subscriptionRow
+		if err := rows.Scan(&feed.Name, &feed.Link, &feed.Subscribed); err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, rows.Err()
+}
+
+// subscription returns the feed named feed, marking whether the account is
+// subscribed to it.
+func (s *sqlStore) subscription(accountID int64, feed string) (subscriptionRow, error) {
+	row := subscriptionRow{Name: feed}
+	err := s.db.QueryRow(`
+		SELECT feed.link, subscription.feed IS NOT NULL
+		FROM feed
+		LEFT JOIN subscription ON subscription.feed = feed.name AND subscription.account = $2
+		WHERE feed.name = $1
+	`, feed, accountID).Scan(&row.Link, &row.Subscribed)
+	return row, err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreateAccountEmail(t *testing.T) {
+	st := openTestStore(t)
+	c := &classifier{zeroMode: true}
+
+	for i, email := range []string{
+		"not an address",
+		"Alice <alice@example.com>",
+		"alice@example.com\r\nBcc: everyone@example.com",
+		"alice@example.com, bob@example.com",
+	} {
+		if _, err := createAccount(st, c, fmt.Sprintf("bad%d", i), "password1", email); err == nil {
+			t.Errorf("Created an account with email %q", email)
+		}
+	}
+
+	a, err := createAccount(st, c, "alice", "password1", " alice@example.com ")
+	if err != nil {
+		t.Fatal(err)
+	} else if a.Email != "alice@example.com" {
+		t.Errorf("Got email %q, want alice@example.com", a.Email)
+	}
+
+	if _, err := createAccount(st, c, "bob", "password1", ""); err != nil {
+		t.Errorf("Creating an account without email: %s", err)
+	}
+}
+
+func TestRequireAccount(t *testing.T) {
+	st := openTestStore(t)
+	a := addTestAccount(t, st, "alice")
+	token := testToken(t, st, a)
+
+	// A session cookie, and the CSRF token that goes with it.
+	w := httptest.NewRecorder()
+	if err := startSession(st, w, a, false); err != nil {
+		t.Fatal(err)
+	}
+	session := w.Result().Cookies()[0]
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(session)
+	csrf := csrfToken(r)
+
+	// Every path answers with the account it was reached as, if any.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			io.WriteString(w, "public")
+		} else {
+			io.WriteString(w, accountFrom(r).Name)
+		}
+	})
+	pages := &errorPage{templ: template.Must(template.ParseFiles("template.html"))}
+	h := requireAccount(st, pages, mux)
+
+	for _, test := range []struct {
+		name         string
+		method, path string
+		form         string
+		session      bool
+		header       map[string]string
+		status       int
+		location     string
+	}{
+		{name: "page without session", method: "GET", path: "/", status: http.StatusFound, location: "/login"},
+		{name: "API without token", method: "GET", path: "/api/v1/items", status: http.StatusUnauthorized},
+		{name: "API with unknown token", method: "GET", path: "/api/v1/items", header: map[string]string{"Authorization": "Bearer nope"}, status: http.StatusUnauthorized},
+		{name: "API with token", method: "POST", path: "/api/v1/items", header: map[string]string{"Authorization": "Bearer " + token}, status: http.StatusOK},
+		{name: "feed without token", method: "GET", path: "/out/atom.xml", status: http.StatusUnauthorized},
+		{name: "feed with unknown token", method: "GET", path: "/out/atom.xml?token=nope", status: http.StatusUnauthorized},
+		{name: "feed with token", method: "GET", path: "/out/atom.xml?token=" + a.FeedToken, status: http.StatusOK},
+		{name: "feed token elsewhere", method: "GET", path: "/api/v1/items?token=" + a.FeedToken, status: http.StatusUnauthorized},
+		{name: "page with session", method: "GET", path: "/", session: true, status: http.StatusOK},
+		{name: "post without CSRF", method: "POST", path: "/judge", session: true, status: http.StatusForbidden},
+		{name: "post with wrong CSRF", method: "POST", path: "/judge", form: "csrf=nope", session: true, status: http.StatusForbidden},
+		{name: "post with CSRF field", method: "POST", path: "/judge", form: "csrf=" + csrf, session: true, status: http.StatusOK},
+		{name: "post with CSRF header", method: "POST", path: "/judge", session: true, header: map[string]string{csrfHeader: csrf}, status: http.StatusOK},
+		{name: "API post with session and no CSRF", method: "POST", path: "/api/v1/items", session: true, status: http.StatusForbidden},
+		{name: "login without session", method: "POST", path: "/login", status: http.StatusOK},
+		{name: "logout without CSRF", method: "POST", path: "/logout", session: true, status: http.StatusForbidden},
+		{name: "logout with CSRF", method: "POST", path: "/logout", form: "csrf=" + csrf, session: true, status: http.StatusOK},
+	} {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.form))
+		if test.form != "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if test.session {
+			r.AddCookie(session)
+		}
+		for name, value := range test.header {
+			r.Header.Set(name, value)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("%s: got Location %q, want %q", test.name, location, test.location)
+		}
+		if want := "alice"; w.Code == http.StatusOK {
+			if publicPaths[r.URL.Path] {
+				want = "public"
+			}
+			if got := w.Body.String(); got != want {
+				t.Errorf("%s: got body %q, want %q", test.name, got, want)
+			}
+		}
+	}
+}
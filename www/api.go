@@ -0,0 +1,704 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// api serves the JSON API under /api/v1/, on top of the same storage and
+// ranking as the HTML pages, for the account the request is authenticated as.
+type api struct {
+	store      Store
+	arch       *archive
+	classifier *classifier
+	modelPath  string
+
+	// rankers can be picked with the ranker query parameter, as on the
+	// index page; defaultRanker, index.ranker, is used otherwise.
+	rankers       map[string]ranker
+	defaultRanker string
+
+	// admins are the names of the accounts that may change feeds.
+	admins map[string]bool
+}
+
+type apiItem struct {
+	ID         string    `json:"id"`
+	GUID       string    `json:"guid"`
+	Feed       string    `json:"feed"`
+	Feeds      []string  `json:"feeds,omitempty"`
+	Title      string    `json:"title"`
+	Link       string    `json:"link"`
+	Original   string    `json:"original"`
+	Discussion string    `json:"discussion,omitempty"`
+	Score      float64   `json:"score"`
+	Published  time.Time `json:"published"`
+	Action     action    `json:"action,omitempty"`
+	Judgement  *bool     `json:"judgement"`
+}
+
+type apiFeed struct {
+	Name       string `json:"name"`
+	Link       string `json:"link"`
+	Subscribed bool   `json:"subscribed"`
+}
+
+type apiTokenInfo struct {
+	ID       int64      `json:"id"`
+	Name     string     `json:"name"`
+	Token    string     `json:"token,omitempty"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used"`
+}
+
+type apiModel struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Loaded   bool      `json:"loaded"`
+}
+
+type apiError struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Writing API response: %s", err)
+	}
+}
+
+// writeError responds with every API error in the same shape.  Server errors
+// are logged and their details kept from the client.
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	var body apiError
+	body.Error.Status = status
+	body.Error.Message = fmt.Sprintf(format, args...)
+
+	if status >= 500 {
+		log.Printf("API: %s", body.Error.Message)
+		body.Error.Message = http.StatusText(status)
+	}
+
+	writeJSON(w, status, body)
+}
+
+func (a *api) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/items", a.items)
+	mux.HandleFunc("/api/v1/items/", a.itemJudgement)
+	mux.HandleFunc("/api/v1/feeds", a.feeds)
+	mux.HandleFunc("/api/v1/feeds/", a.feed)
+	mux.HandleFunc("/api/v1/subscriptions/", a.subscription)
+	mux.HandleFunc("/api/v1/tokens", a.tokens)
+	mux.HandleFunc("/api/v1/tokens/", a.token)
+	mux.HandleFunc("/api/v1/models", a.models)
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "No such endpoint %s", r.URL.Path)
+	})
+}
+
+func toAPIItem(item feedItem, a sql.NullString, judgement sql.NullBool) apiItem {
+	out := apiItem{
+		ID:         item.ID(),
+		GUID:       item.GUID,
+		Feed:       item.Feed,
+		Feeds:      item.Feeds,
+		Title:      item.Title,
+		Link:       item.Link,
+		Original:   item.Original(),
+		Discussion: item.Discussion(),
+		Score:      item.Score,
+		Published:  item.Published,
+		Action:     action(a.String),
+	}
+	if judgement.Valid {
+		out.Judgement = &judgement.Bool
+	}
+	return out
+}
+
+// judgedItem is an item with the account's action on it and the judgement
+// that implies, either of which may be NULL.
+type judgedItem struct {
+	feedItem
+	Action    sql.NullString
+	Judgement sql.NullBool
+}
+
+// itemFilter picks which of an account's items judgedItems returns.
+type itemFilter int
+
+const (
+	// Items the account has judged or taken an action on.
+	itemsJudged itemFilter = iota
+	// Items the account saved for later.
+	itemsLater
+	// Every item offered to the account.
+	itemsAll
+)
+
+// judgedItems returns up to limit of the account's items, newest first, that
+// are not duplicates and pass filter.
+func (s *sqlStore) judgedItems(accountID int64, filter itemFilter, limit int) ([]judgedItem, error) {
+	var condition string
+	switch filter {
+	case itemsJudged:
+		condition = `user_item.action IS NOT NULL OR user_item.judgement IS NOT NULL`
+	case itemsLater:
+		condition = `user_item.action = 'later'`
+	case itemsAll:
+		condition = `TRUE`
+	default:
+		return nil, fmt.Errorf("Unknown item filter %d", filter)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT item.guid, item.feed, item.title, item.link, item.canonical, user_item.score, item.published, user_item.action, user_item.judgement
+		FROM item
+		JOIN user_item ON user_item.guid = item.guid AND user_item.account = $1
+		WHERE item.duplicate_of IS NULL AND (`+condition+`)
+		ORDER BY item.published DESC
+		LIMIT $2
+	`, accountID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []judgedItem
+	for rows.Next() {
+		var item judgedItem
+		if err := rows.Scan(&item.GUID, &item.Feed, &item.Title, &item.Link, &item.Canonical, &item.Score, &item.Published, &item.Action, &item.Judgement); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// items lists items in a given state: unjudged items in the order the index
+// page would offer them with the same ranker, or judged, saved or all items
+// newest first.
+func (a *api) items(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+
+	limit := 50
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > 1000 {
+			writeError(w, http.StatusBadRequest, "limit must be a number from 1 to 1000")
+			return
+		}
+	}
+
+	accountID := accountFrom(r).ID
+	items := make([]apiItem, 0)
+
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		state = "unjudged"
+	}
+
+	if state == "unjudged" {
+		rankerName := r.URL.Query().Get("ranker")
+		if rankerName == "" {
+			rankerName = a.defaultRanker
+		}
+
+		rank, ok := a.rankers[rankerName]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "Unknown ranker %q", rankerName)
+			return
+		}
+
+		candidates, err := a.store.pendingCandidates(accountID, byScore, rankingWindow)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Listing unjudged items: %s", err)
+			return
+		}
+
+		rankItems(rank, candidates, time.Now())
+		if len(candidates) > limit {
+			candidates = candidates[:limit]
+		}
+
+		for _, item := range candidates {
+			item.Feeds, err = a.store.itemFeeds(item.GUID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "Listing feeds of %q: %s", item.GUID, err)
+				return
+			}
+			items = append(items, toAPIItem(item, sql.NullString{}, sql.NullBool{}))
+		}
+
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+
+	var filter itemFilter
+	switch state {
+	case "judged":
+		filter = itemsJudged
+	case "later":
+		filter = itemsLater
+	case "all":
+		filter = itemsAll
+	default:
+		writeError(w, http.StatusBadRequest, "Unknown state %q; expected unjudged, judged, later or all", state)
+		return
+	}
+
+	judged, err := a.store.judgedItems(accountID, filter, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Listing items: %s", err)
+		return
+	}
+
+	for _, item := range judged {
+		items = append(items, toAPIItem(item.feedItem, item.Action, item.Judgement))
+	}
+
+	writeJSON(w, http.StatusOK, items)
+}
+
+// itemJudgement records an action on an item, posted as {"action": "love"}
+// to /api/v1/items/{id}/judgement.
+func (a *api) itemJudgement(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/items/"), "/")
+	if len(parts) != 2 || parts[1] != "judgement" {
+		writeError(w, http.StatusNotFound, "No such endpoint %s", r.URL.Path)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+
+	guid, err := guidFromID(parts[0])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "No item with ID %q", parts[0])
+		return
+	}
+
+	accountID := accountFrom(r).ID
+
+	item, err := a.store.loadItem(accountID, guid)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "No item with ID %q", parts[0])
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "Loading item %q: %s", guid, err)
+		return
+	}
+
+	var body struct {
+		Action string `json:"action"`
+		Page   string `json:"page"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "Decoding request body: %s", err)
+		return
+	}
+
+	act, ok := parseAction(body.Action)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Unknown action %q", body.Action)
+		return
+	}
+
+	if err := a.store.judge(accountID, guid, act, false, body.Page); err != nil {
+		writeError(w, http.StatusInternalServerError, "Judging %q: %s", guid, err)
+		return
+	}
+
+	if a.arch != nil && (act == actionClick || act == actionLove) {
+		a.arch.saveInBackground(guid, item.Link)
+	}
+
+	judgement := act.judgement()
+	writeJSON(w, http.StatusOK, toAPIItem(item, sql.NullString{String: string(act), Valid: true}, judgement))
+}
+
+// Feeds are shared by every account, so only admins may change them: an
+// account deleting a feed would delete everyone's subscriptions to it.
+// Other accounts choose what they read with /api/v1/subscriptions/{name}.
+const sharedFeeds = "Only admins can change feeds, which are shared by every account; subscribe with /api/v1/subscriptions/{name}"
+
+// feeds lists the feeds with whether the account subscribes to each.
+func (a *api) feeds(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		subscriptions, err := a.store.listSubscriptions(accountFrom(r).ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Listing feeds: %s", err)
+			return
+		}
+
+		feeds := make([]apiFeed, 0, len(subscriptions))
+		for _, s := range subscriptions {
+			feeds = append(feeds, apiFeed{Name: s.Name, Link: s.Link, Subscribed: s.Subscribed})
+		}
+
+		writeJSON(w, http.StatusOK, feeds)
+
+	case http.MethodPost:
+		if !a.admins[accountFrom(r).Name] {
+			writeError(w, http.StatusForbidden, "%s", sharedFeeds)
+			return
+		}
+
+		feed, ok := decodeFeed(w, r)
+		if !ok {
+			return
+		}
+
+		exists, err := a.store.feedExists(feed.Name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Looking up feed %q: %s", feed.Name, err)
+			return
+		} else if exists {
+			writeError(w, http.StatusConflict, "Feed %q already exists", feed.Name)
+			return
+		}
+
+		// As with "www feed add", every account is subscribed.
+		if err := addFeedForAll(a.store, a.classifier, feed.Name, feed.Link); err != nil {
+			writeError(w, http.StatusInternalServerError, "Adding feed %q: %s", feed.Name, err)
+			return
+		}
+		feed.Subscribed = true
+
+		writeJSON(w, http.StatusCreated, feed)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+}
+
+// feed reads the feed named in /api/v1/feeds/{name}, and lets admins
+// replace or delete it.
+func (a *api) feed(w http.ResponseWriter, r *http.Request) {
+	name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1/feeds/"))
+	if err != nil || name == "" || strings.Contains(name, "/") {
+		writeError(w, http.StatusNotFound, "No such endpoint %s", r.URL.Path)
+		return
+	}
+
+	exists, err := a.store.feedExists(name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Looking up feed %q: %s", name, err)
+		return
+	} else if !exists {
+		writeError(w, http.StatusNotFound, "No feed named %q", name)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s, err := a.store.subscription(accountFrom(r).ID, name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Loading feed %q: %s", name, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, apiFeed{Name: s.Name, Link: s.Link, Subscribed: s.Subscribed})
+
+	case http.MethodPut:
+		if !a.admins[accountFrom(r).Name] {
+			writeError(w, http.StatusForbidden, "%s", sharedFeeds)
+			return
+		}
+
+		feed, ok := decodeFeed(w, r)
+		if !ok {
+			return
+		}
+
+		if feed.Name != name {
+			writeError(w, http.StatusBadRequest, "Feed name %q does not match %q in the path", feed.Name, name)
+			return
+		}
+
+		if err := a.store.updateFeed(name, feed.Link); err != nil {
+			writeError(w, http.StatusInternalServerError, "Updating feed %q: %s", name, err)
+			return
+		}
+
+		s, err := a.store.subscription(accountFrom(r).ID, name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Loading feed %q: %s", name, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, apiFeed{Name: s.Name, Link: s.Link, Subscribed: s.Subscribed})
+
+	case http.MethodDelete:
+		if !a.admins[accountFrom(r).Name] {
+			writeError(w, http.StatusForbidden, "%s", sharedFeeds)
+			return
+		}
+
+		if err := a.store.deleteFeed(name); err != nil {
+			writeError(w, http.StatusInternalServerError, "Deleting feed %q: %s", name, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+}
+
+// subscription subscribes the account to the feed named in
+// /api/v1/subscriptions/{name} on PUT, and unsubscribes it on DELETE.
+func (a *api) subscription(w http.ResponseWriter, r *http.Request) {
+	name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1/subscriptions/"))
+	if err != nil || name == "" || strings.Contains(name, "/") {
+		writeError(w, http.StatusNotFound, "No such endpoint %s", r.URL.Path)
+		return
+	}
+
+	exists, err := a.store.feedExists(name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Looking up feed %q: %s", name, err)
+		return
+	} else if !exists {
+		writeError(w, http.StatusNotFound, "No feed named %q", name)
+		return
+	}
+
+	accountID := accountFrom(r).ID
+
+	switch r.Method {
+	case http.MethodPut:
+		if err := subscribe(a.store, a.classifier, accountID, name); err != nil {
+			writeError(w, http.StatusInternalServerError, "Subscribing to feed %q: %s", name, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if err := a.store.unsubscribe(accountID, name); err != nil {
+			writeError(w, http.StatusInternalServerError, "Unsubscribing from feed %q: %s", name, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+}
+
+// tokens lists the account's API tokens on GET, and creates one from a
+// {"name": ...} body on POST.  The token itself is only ever in the response
+// to POST.
+func (a *api) tokens(w http.ResponseWriter, r *http.Request) {
+	accountID := accountFrom(r).ID
+
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := a.store.listTokens(accountID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Listing tokens: %s", err)
+			return
+		}
+
+		out := make([]apiTokenInfo, 0, len(tokens))
+		for _, t := range tokens {
+			out = append(out, toAPIToken(t))
+		}
+
+		writeJSON(w, http.StatusOK, out)
+
+	case http.MethodPost:
+		var body struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "Decoding request body: %s", err)
+			return
+		}
+
+		t, token, err := createToken(a.store, accountID, body.Name)
+		if err == errTokenName {
+			writeError(w, http.StatusBadRequest, "%s", err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "Creating token: %s", err)
+			return
+		}
+
+		info := toAPIToken(t)
+		info.Token = token
+		writeJSON(w, http.StatusCreated, info)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+}
+
+// token revokes the token with the ID in /api/v1/tokens/{id} on DELETE.
+func (a *api) token(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "No such endpoint %s", r.URL.Path)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+
+	ok, err := a.store.revokeToken(accountFrom(r).ID, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Revoking token %d: %s", id, err)
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, "No token %d", id)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func toAPIToken(t apiToken) apiTokenInfo {
+	info := apiTokenInfo{
+		ID:      t.ID,
+		Name:    t.Name,
+		Created: t.Created,
+	}
+	if t.LastUsed.Valid {
+		info.LastUsed = &t.LastUsed.Time
+	}
+	return info
+}
+
+// decodeFeed reads a feed from the request body, responding with an error
+// and returning false if it is not valid.
+func decodeFeed(w http.ResponseWriter, r *http.Request) (apiFeed, bool) {
+	var feed apiFeed
+	if err := json.NewDecoder(r.Body).Decode(&feed); err != nil {
+		writeError(w, http.StatusBadRequest, "Decoding request body: %s", err)
+		return feed, false
+	}
+
+	if err := checkFeed(feed.Name, feed.Link); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return feed, false
+	}
+
+	return feed, true
+}
+
+// checkFeed returns an error if name or link cannot be used for a feed.
+func checkFeed(name, link string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("Feed name must be non-empty and not contain a slash")
+	}
+
+	if u, err := url.Parse(link); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("Feed link %q is not an http or https URL", link)
+	}
+
+	return nil
+}
+
+func (s *sqlStore) feedExists(name string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM feed WHERE name = $1)
+	`, name).Scan(&exists)
+	return exists, err
+}
+
+func (s *sqlStore) addFeed(name, link string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO feed (name, link)
+		VALUES ($1, $2)
+	`, name, link)
+	return err
+}
+
+func (s *sqlStore) updateFeed(name, link string) error {
+	_, err := s.db.Exec(`
+		UPDATE feed
+		SET link = $1
+		WHERE name = $2
+	`, link, name)
+	return err
+}
+
+// deleteFeed deletes the feed named name and every subscription to it.
+func (s *sqlStore) deleteFeed(name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DELETE FROM feed
+		WHERE name = $1
+	`, name); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		DELETE FROM subscription
+		WHERE feed = $1
+	`, name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// models lists the classifier models on disk.
+func (a *api) models(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		return
+	}
+
+	files, err := listModels(a.modelPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Listing models: %s", err)
+		return
+	}
+
+	// The live model is the one the classifier loaded, unless it was
+	// promoted after the server started.
+	models := make([]apiModel, 0, len(files))
+	for _, m := range files {
+		models = append(models, apiModel{
+			Path:     m.Path,
+			Size:     m.Size,
+			Modified: m.Modified,
+			Loaded:   m.Live && !a.classifier.zeroMode,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, models)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAPI returns a handler serving the API as the server does, behind
+// requireAccount, with admins as its admins.  Its index.ranker is boost,
+// which boosts the feed named boosted, so that the default is not simply
+// the order of the scores.
+func newTestAPI(t *testing.T, st Store, admins ...string) http.Handler {
+	t.Helper()
+
+	a := &api{
+		store:         st,
+		classifier:    &classifier{zeroMode: true},
+		rankers:       newRankers(24*time.Hour, map[string]float64{"boosted": 10}),
+		defaultRanker: "boost",
+		admins:        make(map[string]bool),
+	}
+	for _, name := range admins {
+		a.admins[name] = true
+	}
+
+	mux := http.NewServeMux()
+	a.register(mux)
+
+	pages := &errorPage{templ: template.Must(template.ParseFiles("template.html"))}
+	return requireAccount(st, pages, mux)
+}
+
+// testToken returns a new API token for the account.
+func testToken(t *testing.T, st Store, a account) string {
+	t.Helper()
+
+	_, token, err := createToken(st, a.ID, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// apiRequest makes a request of h with the token, if any, and body, if any,
+// as JSON.
+func apiRequest(t *testing.T, h http.Handler, token, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var r *http.Request
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = httptest.NewRequest(method, path, strings.NewReader(string(b)))
+		r.Header.Set("Content-Type", "application/json")
+	} else {
+		r = httptest.NewRequest(method, path, nil)
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIFeedsAdmin(t *testing.T) {
+	st := openTestStore(t)
+	alice := addTestAccount(t, st, "alice")
+	bob := addTestAccount(t, st, "bob")
+	h := newTestAPI(t, st, "alice")
+	aliceToken, bobToken := testToken(t, st, alice), testToken(t, st, bob)
+
+	feed := apiFeed{Name: "xkcd", Link: "https://xkcd.com/atom.xml"}
+
+	if w := apiRequest(t, h, bobToken, http.MethodPost, "/api/v1/feeds", feed); w.Code != http.StatusForbidden {
+		t.Errorf("Got status %d adding a feed as a non-admin, want 403", w.Code)
+	}
+
+	if w := apiRequest(t, h, aliceToken, http.MethodPost, "/api/v1/feeds", feed); w.Code != http.StatusCreated {
+		t.Fatalf("Got status %d adding a feed as an admin, want 201: %s", w.Code, w.Body)
+	}
+	if w := apiRequest(t, h, aliceToken, http.MethodPost, "/api/v1/feeds", feed); w.Code != http.StatusConflict {
+		t.Errorf("Got status %d adding the feed again, want 409", w.Code)
+	}
+
+	// Added feeds are shared, so everyone is subscribed.
+	if s, err := st.subscription(bob.ID, "xkcd"); err != nil {
+		t.Fatal(err)
+	} else if !s.Subscribed {
+		t.Error("bob was not subscribed to the added feed")
+	}
+
+	feed.Link = "https://xkcd.com/rss.xml"
+	if w := apiRequest(t, h, bobToken, http.MethodPut, "/api/v1/feeds/xkcd", feed); w.Code != http.StatusForbidden {
+		t.Errorf("Got status %d changing a feed as a non-admin, want 403", w.Code)
+	}
+	if w := apiRequest(t, h, aliceToken, http.MethodPut, "/api/v1/feeds/xkcd", feed); w.Code != http.StatusOK {
+		t.Errorf("Got status %d changing a feed as an admin, want 200: %s", w.Code, w.Body)
+	}
+
+	var got apiFeed
+	w := apiRequest(t, h, bobToken, http.MethodGet, "/api/v1/feeds/xkcd", nil)
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	} else if got.Link != feed.Link || !got.Subscribed {
+		t.Errorf("Got feed %+v after changing it, want %+v subscribed", got, feed)
+	}
+
+	if w := apiRequest(t, h, bobToken, http.MethodDelete, "/api/v1/feeds/xkcd", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Got status %d deleting a feed as a non-admin, want 403", w.Code)
+	}
+	if w := apiRequest(t, h, aliceToken, http.MethodDelete, "/api/v1/feeds/xkcd", nil); w.Code != http.StatusNoContent {
+		t.Errorf("Got status %d deleting a feed as an admin, want 204", w.Code)
+	}
+	if w := apiRequest(t, h, bobToken, http.MethodGet, "/api/v1/feeds/xkcd", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d for a deleted feed, want 404", w.Code)
+	}
+}
+
+func TestAPIItemsRanker(t *testing.T) {
+	st := openTestStore(t)
+
+	now := time.Now()
+	alice := addTestAccount(t, st, "alice",
+		feedItem{GUID: "best", Feed: "f", Title: "Best", Link: "https://example.com/best", Published: now, Score: 0.9},
+		feedItem{GUID: "boosted", Feed: "boosted", Title: "Boosted", Link: "https://example.com/boosted", Published: now, Score: 0.5},
+	)
+	h := newTestAPI(t, st)
+	token := testToken(t, st, alice)
+
+	for _, test := range []struct {
+		query string
+		first string
+	}{
+		{"", "boosted"},
+		{"?ranker=boost", "boosted"},
+		{"?ranker=score", "best"},
+	} {
+		w := apiRequest(t, h, token, http.MethodGet, "/api/v1/items"+test.query, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %d for items%s: %s", w.Code, test.query, w.Body)
+		}
+
+		var items []apiItem
+		if err := json.NewDecoder(w.Body).Decode(&items); err != nil {
+			t.Fatal(err)
+		} else if len(items) != 2 || items[0].GUID != test.first {
+			t.Errorf("Got items %+v for items%s, want %s first", items, test.query, test.first)
+		}
+	}
+
+	if w := apiRequest(t, h, token, http.MethodGet, "/api/v1/items?ranker=unknown", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for an unknown ranker, want 400", w.Code)
+	}
+}
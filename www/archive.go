@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/yhat/scrape"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Resources larger than this are left linked rather than inlined.
+	maxInlinedResource = 2 << 20
+
+	// Once this much has been inlined into a page, later resources are left
+	// linked.
+	maxInlinedPerPage = 20 << 20
+)
+
+var archiveClient = &http.Client{Timeout: time.Minute}
+
+// archive keeps self-contained snapshots of pages in a directory, named by
+// the SHA-256 of their contents, and records in the snapshot table which
+// item each belongs to.
+type archive struct {
+	store    Store
+	dir      string
+	maxBytes int64
+
+	// Serializes pruning with saving, so a snapshot is never deleted between
+	// being written and being recorded, and saves of the same item with each
+	// other.
+	mutex sync.Mutex
+
+	// Counts the saves running in the background.
+	saving sync.WaitGroup
+}
+
+func newArchive(store Store, dir string, maxBytes int64) (*archive, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Creating archive directory: %s", err)
+	}
+
+	return &archive{
+		store:    store,
+		dir:      dir,
+		maxBytes: maxBytes,
+	}, nil
+}
+
+// parseSize parses a number of bytes with an optional K, M or G suffix.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return n * multiplier, nil
+}
+
+func (a *archive) path(hash string) string {
+	return filepath.Join(a.dir, hash[:2], hash+".html")
+}
+
+// save snapshots link as the archived copy of guid, unless guid already has
+// one, and then prunes the archive back under its size limit.
+func (a *archive) save(guid, link string) error {
+	if _, exists, err := a.store.snapshotHash(guid); err != nil {
+		return err
+	} else if exists {
+		return nil
+	}
+
+	log.Printf("Archiving %q", link)
+
+	data, err := snapshotPage(link)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// Another save of guid may have finished while this one was fetching,
+	// and a file written now would never be recorded, nor pruned.
+	if _, exists, err := a.store.snapshotHash(guid); err != nil {
+		return err
+	} else if exists {
+		return nil
+	}
+
+	path := a.path(hash)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+
+		temp, err := ioutil.TempFile(filepath.Dir(path), "snapshot")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(temp.Name())
+
+		if _, err := temp.Write(data); err != nil {
+			temp.Close()
+			return err
+		}
+
+		if err := temp.Close(); err != nil {
+			return err
+		}
+
+		if err := os.Rename(temp.Name(), path); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := a.store.addSnapshot(guid, hash, int64(len(data)), time.Now()); err != nil {
+		return err
+	}
+
+	return a.prune()
+}
+
+// saveInBackground archives link without making the caller wait, logging
+// any failure.
+func (a *archive) saveInBackground(guid, link string) {
+	a.saving.Add(1)
+	go func() {
+		defer a.saving.Done()
+		if err := a.save(guid, link); err != nil {
+			log.Printf("Archiving %q: %s", link, err)
+		}
+	}()
+}
+
+// wait waits for the saves running in the background to finish.
+func (a *archive) wait() {
+	a.saving.Wait()
+}
+
+// prune deletes the least recently archived snapshots until the archive
+// fits in maxBytes.  Must be called with the mutex held.
+func (a *archive) prune() error {
+	snapshots, err := a.store.snapshots()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, snapshot := range snapshots {
+		total += snapshot.Size
+		if total <= a.maxBytes {
+			continue
+		}
+
+		log.Printf("Pruning snapshot %s from archive", snapshot.Hash)
+
+		if err := a.store.deleteSnapshots(snapshot.Hash); err != nil {
+			return err
+		}
+
+		if err := os.Remove(a.path(snapshot.Hash)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// open returns the snapshot archived for guid, or an error satisfying
+// os.IsNotExist if there is none.
+func (a *archive) open(guid string) (*os.File, error) {
+	hash, ok, err := a.store.snapshotHash(guid)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return os.Open(a.path(hash))
+}
+
+// has reports whether guid has been archived.
+func (a *archive) has(guid string) (bool, error) {
+	_, ok, err := a.store.snapshotHash(guid)
+	return ok, err
+}
+
+// snapshotFile is a file in the archive, which may hold the snapshots of
+// several items.
+type snapshotFile struct {
+	Hash string
+	Size int64
+}
+
+// snapshots returns every file in the archive, most recently archived
+// first.
+func (s *sqlStore) snapshots() ([]snapshotFile, error) {
+	rows, err := s.db.Query(`
+		SELECT hash, size
+		FROM snapshot
+		GROUP BY hash, size
+		ORDER BY max(created) DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []snapshotFile
+	for rows.Next() {
+		var f snapshotFile
+		if err := rows.Scan(&f.Hash, &f.Size); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// snapshotHash returns the hash of the snapshot archived for guid, or false
+// if there is none.
+func (s *sqlStore) snapshotHash(guid string) (string, bool, error) {
+	var hash string
+	err := s.db.QueryRow(`
+		SELECT hash
+		FROM snapshot
+		WHERE guid = $1
+	`, guid).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return hash, true, nil
+}
+
+func (s *sqlStore) addSnapshot(guid, hash string, size int64, created time.Time) error {
+	_, err := s.db.Exec(`
+		INSERT INTO snapshot (guid, hash, size, created)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (guid) DO NOTHING
+	`, guid, hash, size, created.UTC())
+	return err
+}
+
+// deleteSnapshots forgets every snapshot stored in the file with the given
+// hash.
+func (s *sqlStore) deleteSnapshots(hash string) error {
+	_, err := s.db.Exec(`
+		DELETE FROM snapshot
+		WHERE hash = $1
+	`, hash)
+	return err
+}
+
+// fetchDataURI downloads link and encodes it as a data: URI, provided it is
+// no larger than limit.
+func fetchDataURI(link string, limit int) (string, error) {
+	res, err := archiveClient.Get(link)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Fetching %q: %s", link, res.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, int64(limit)+1))
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) > limit {
+		return "", fmt.Errorf("Fetching %q: larger than %d bytes", link, limit)
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	} else {
+		contentType = http.DetectContentType(data)
+	}
+
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// snapshotPage downloads link and returns it as a single HTML document with
+// scripts removed, images and stylesheets inlined and links made absolute.
+// Nothing is left that would take the reader elsewhere by itself: refreshes,
+// base URLs and the targets of forms are removed too.
+func snapshotPage(link string) ([]byte, error) {
+	res, err := archiveClient.Get(link)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching %q: %s", link, res.Status)
+	}
+
+	root, err := html.Parse(io.LimitReader(res.Body, maxPageBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	base := res.Request.URL
+	budget := maxInlinedPerPage
+
+	resolve := func(ref string) (*url.URL, bool) {
+		u, err := base.Parse(strings.TrimSpace(ref))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, false
+		}
+		return u, true
+	}
+
+	inline := func(ref string) (string, bool) {
+		u, ok := resolve(ref)
+		if !ok || budget <= 0 {
+			return "", false
+		}
+
+		uri, err := fetchDataURI(u.String(), maxInlinedResource)
+		if err != nil {
+			log.Printf("Archiving %q: %s", link, err)
+			return "", false
+		}
+
+		budget -= len(uri)
+		return uri, true
+	}
+
+	setAttr := func(n *html.Node, key, val string) {
+		for i := range n.Attr {
+			if n.Attr[i].Key == key {
+				n.Attr[i].Val = val
+				return
+			}
+		}
+		n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+	}
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+
+			if c.Type == html.ElementNode {
+				switch c.DataAtom {
+				case atom.Script, atom.Noscript, atom.Iframe, atom.Object, atom.Embed, atom.Base:
+					n.RemoveChild(c)
+					c = next
+					continue
+				case atom.Meta:
+					if strings.EqualFold(strings.TrimSpace(scrape.Attr(c, "http-equiv")), "refresh") {
+						n.RemoveChild(c)
+						c = next
+						continue
+					}
+				}
+
+				attrs := c.Attr[:0]
+				for _, attr := range c.Attr {
+					switch {
+					case strings.HasPrefix(attr.Key, "on"), attr.Key == "srcset", attr.Key == "formaction":
+					case c.DataAtom == atom.Form && attr.Key == "action":
+					default:
+						attrs = append(attrs, attr)
+					}
+				}
+				c.Attr = attrs
+
+				for _, attr := range c.Attr {
+					switch {
+					case c.DataAtom == atom.Img && attr.Key == "src":
+						if uri, ok := inline(attr.Val); ok {
+							setAttr(c, "src", uri)
+						}
+					case c.DataAtom == atom.Link && attr.Key == "href":
+						rel := strings.ToLower(scrape.Attr(c, "rel"))
+						if strings.Contains(rel, "stylesheet") {
+							if uri, ok := inline(attr.Val); ok {
+								setAttr(c, "href", uri)
+							}
+						} else if u, ok := resolve(attr.Val); ok {
+							setAttr(c, "href", u.String())
+						}
+					case c.DataAtom == atom.A && attr.Key == "href":
+						if u, ok := resolve(attr.Val); ok {
+							setAttr(c, "href", u.String())
+						}
+					}
+				}
+			}
+
+			walk(c)
+			c = next
+		}
+	}
+	walk(root)
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, root); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
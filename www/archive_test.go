@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{" 512 ", 512},
+		{"512B", 512},
+		{"64K", 64 << 10},
+		{"64kb", 64 << 10},
+		{"10M", 10 << 20},
+		{"1GB", 1 << 30},
+		{"2g", 2 << 30},
+	} {
+		if got, err := parseSize(test.s); err != nil {
+			t.Errorf("parseSize(%q): %s", test.s, err)
+		} else if got != test.want {
+			t.Errorf("parseSize(%q) = %d, want %d", test.s, got, test.want)
+		}
+	}
+
+	for _, s := range []string{"", "K", "lots", "1.5G", "1T", "10 M"} {
+		if n, err := parseSize(s); err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", s, n)
+		}
+	}
+}
+
+func TestArchiveSaveConcurrently(t *testing.T) {
+	// Every fetch of the page differs, as pages with ads or timestamps do.
+	var fetches int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<html><body><p>Fetch %d</p></body></html>", atomic.AddInt64(&fetches, 1))
+	}))
+	defer server.Close()
+
+	st := openTestStore(t)
+	dir := t.TempDir()
+	arch, err := newArchive(st, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := arch.save("a", server.URL); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	snapshots, err := st.snapshots()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(snapshots) != 1 {
+		t.Fatalf("Got %d snapshots, want 1", len(snapshots))
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.html"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) != 1 || files[0] != arch.path(snapshots[0].Hash) {
+		t.Errorf("Got files %v, want only %s", files, arch.path(snapshots[0].Hash))
+	}
+
+	f, err := arch.open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err := arch.open("b"); !os.IsNotExist(err) {
+		t.Errorf("Got %v opening a snapshot never saved, want it not to exist", err)
+	}
+}
+
+func TestSnapshotPage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<!DOCTYPE html>
+<html>
+<head>
+	<base href="https://elsewhere.example/">
+	<meta http-equiv="Refresh" content="0; url=https://elsewhere.example/">
+	<meta charset="utf-8">
+	<script>location = "https://elsewhere.example/"</script>
+</head>
+<body onload="steal()">
+	<p>The story <a href="/more">continues</a>.</p>
+	<form action="https://elsewhere.example/login" method="POST">
+		<input name="password">
+		<button formaction="https://elsewhere.example/other">Log in</button>
+	</form>
+</body>
+</html>`)
+	}))
+	defer server.Close()
+
+	page, err := snapshotPage(server.URL + "/story")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := string(page)
+	if strings.Contains(snapshot, "elsewhere.example") || strings.Contains(snapshot, "steal") {
+		t.Errorf("Snapshot still leads elsewhere:\n%s", snapshot)
+	}
+	if !strings.Contains(snapshot, `<a href="`+server.URL+`/more">continues</a>`) {
+		t.Errorf("Snapshot lost the story or its absolute link:\n%s", snapshot)
+	}
+	if !strings.Contains(snapshot, `<meta charset="utf-8"/>`) {
+		t.Errorf("Snapshot lost the other meta tags:\n%s", snapshot)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Number of words of article text appended to an item's classifiable string.
+// train/main.go must use the same number.
+const articleFeatureWords = 100
+
+var articleClient = &http.Client{Timeout: 30 * time.Second}
+
+var (
+	unlikelyRe = regexp.MustCompile(`(?i)comment|sidebar|footer|footnote|nav|menu|share|social|promo|related|advert|sponsor|subscribe|newsletter|cookie|popup|banner|breadcrumb|masthead`)
+	likelyRe   = regexp.MustCompile(`(?i)article|body|content|entry|main|post|story|text`)
+)
+
+// Elements which never hold the readable part of a page.
+var skippedAtoms = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Nav:      true,
+	atom.Header:   true,
+	atom.Footer:   true,
+	atom.Aside:    true,
+	atom.Form:     true,
+	atom.Iframe:   true,
+	atom.Svg:      true,
+	atom.Button:   true,
+	atom.Figure:   true,
+}
+
+// Elements whose text becomes a paragraph of the extracted article.
+var paragraphAtoms = map[atom.Atom]bool{
+	atom.P:          true,
+	atom.H2:         true,
+	atom.H3:         true,
+	atom.H4:         true,
+	atom.Li:         true,
+	atom.Blockquote: true,
+	atom.Pre:        true,
+}
+
+type article struct {
+	Text      string
+	WordCount int
+}
+
+// Paragraphs splits the article text back into the paragraphs it was
+// extracted from.
+func (a article) Paragraphs() []string {
+	if a.Text == "" {
+		return nil
+	}
+	return strings.Split(a.Text, "\n\n")
+}
+
+func nodeText(n *html.Node) string {
+	var b strings.Builder
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+			b.WriteByte(' ')
+			return
+		}
+		if n.Type == html.ElementNode && skippedAtoms[n.DataAtom] {
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func linkDensity(n *html.Node, textLength int) float64 {
+	if textLength == 0 {
+		return 0
+	}
+
+	linkLength := 0
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.A {
+			linkLength += len(nodeText(n))
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+
+	return float64(linkLength) / float64(textLength)
+}
+
+func classWeight(n *html.Node) float64 {
+	var classAndID string
+	for _, attr := range n.Attr {
+		if attr.Key == "class" || attr.Key == "id" {
+			classAndID += " " + attr.Val
+		}
+	}
+
+	weight := 0.0
+	if unlikelyRe.MatchString(classAndID) {
+		weight -= 25
+	}
+	if likelyRe.MatchString(classAndID) {
+		weight += 25
+	}
+	return weight
+}
+
+// extractArticle finds the element of root most likely to hold the main
+// content, in the manner of Readability: each paragraph awards points for
+// its length and commas to its parent and half as many to its grandparent,
+// and the candidate with most points after discounting links wins.
+func extractArticle(root *html.Node) article {
+	scores := make(map[*html.Node]float64)
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if skippedAtoms[n.DataAtom] {
+				return
+			}
+			if n.DataAtom != atom.Body && n.DataAtom != atom.Article && classWeight(n) < 0 {
+				return
+			}
+			if n.DataAtom == atom.P || n.DataAtom == atom.Pre || n.DataAtom == atom.Blockquote {
+				text := nodeText(n)
+				if len(text) >= 25 && n.Parent != nil {
+					points := 1 + float64(strings.Count(text, ",")) + math.Min(float64(len(text)/100), 3)
+
+					if _, ok := scores[n.Parent]; !ok {
+						scores[n.Parent] = classWeight(n.Parent)
+					}
+					scores[n.Parent] += points
+
+					if grandparent := n.Parent.Parent; grandparent != nil {
+						if _, ok := scores[grandparent]; !ok {
+							scores[grandparent] = classWeight(grandparent)
+						}
+						scores[grandparent] += points / 2
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	var best *html.Node
+	bestScore := 0.0
+	for n, score := range scores {
+		score *= 1 - linkDensity(n, len(nodeText(n)))
+		if best == nil || score > bestScore {
+			best, bestScore = n, score
+		}
+	}
+
+	if best == nil {
+		return article{}
+	}
+
+	var paragraphs []string
+	words := 0
+
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if skippedAtoms[n.DataAtom] || classWeight(n) < 0 {
+				return
+			}
+			if paragraphAtoms[n.DataAtom] {
+				text := nodeText(n)
+				if text != "" && linkDensity(n, len(text)) < 0.5 {
+					paragraphs = append(paragraphs, text)
+					words += len(strings.Fields(text))
+				}
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			collect(c)
+		}
+	}
+	collect(best)
+
+	return article{
+		Text:      strings.Join(paragraphs, "\n\n"),
+		WordCount: words,
+	}
+}
+
+func fetchArticle(link string) (article, error) {
+	res, err := articleClient.Get(link)
+	if err != nil {
+		return article{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return article{}, fmt.Errorf("Fetching article %q: %s", link, res.Status)
+	}
+
+	if contentType := res.Header.Get("Content-Type"); !strings.Contains(contentType, "html") {
+		return article{}, fmt.Errorf("Fetching article %q: not HTML but %q", link, contentType)
+	}
+
+	root, err := html.Parse(io.LimitReader(res.Body, maxPageBytes))
+	if err != nil {
+		return article{}, err
+	}
+
+	return extractArticle(root), nil
+}
+
+// storeArticle saves the article extracted for guid, which is not fetched
+// again even if it is empty.  Articles which could not be fetched are not
+// stored, so that they are tried again.
+func (s *sqlStore) storeArticle(guid string, a article) error {
+	_, err := s.db.Exec(`
+		INSERT INTO article (guid, text, word_count, fetched)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (guid) DO UPDATE
+		SET text = excluded.text, word_count = excluded.word_count, fetched = excluded.fetched
+	`, guid, a.Text, a.WordCount, time.Now().UTC())
+	return err
+}
+
+// loadArticle returns the article stored for guid, and false if none has
+// been fetched yet.
+func (s *sqlStore) loadArticle(guid string) (article, bool, error) {
+	var a article
+	err := s.db.QueryRow(`
+		SELECT text, word_count
+		FROM article
+		WHERE guid = $1
+	`, guid).Scan(&a.Text, &a.WordCount)
+	if err == sql.ErrNoRows {
+		return article{}, false, nil
+	} else if err != nil {
+		return article{}, false, err
+	}
+	return a, true, nil
+}
+
+// fetchArticles downloads and extracts the article behind every item that
+// some account has not judged or has saved and that does not have one yet,
+// and rescores the item for those accounts with its text.  It stops early
+// with ctx's error once ctx is done.
+func fetchArticles(ctx context.Context, classifier *classifier, st Store) error {
+	log.Printf("Fetching articles...")
+	defer log.Printf("Done fetching articles")
+
+	items, err := st.itemsWithoutArticles()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// The canonical link is rewritten for comparison and need not be
+		// served at all, so the article is fetched from the item's own link.
+		a, err := fetchArticle(item.Link)
+		if err != nil {
+			log.Printf("Fetching article for %q: %s", item.GUID, err)
+			continue
+		}
+
+		if err := st.storeArticle(item.GUID, a); err != nil {
+			return err
+		}
+
+		if a.Text == "" {
+			continue
+		}
+
+		item.Text = a.Text
+		if err := rescore(st, classifier, item); err != nil {
+			log.Printf("Updating scores for item %q: %s", item.GUID, err)
+		}
+	}
+
+	return nil
+}
+
+// itemsWithoutArticles returns the items linking to a web page, and so with
+// a canonical link, but no article that some account has not judged or has
+// saved for later.
+func (s *sqlStore) itemsWithoutArticles() ([]feedItem, error) {
+	rows, err := s.db.Query(`
+		SELECT DISTINCT item.guid, item.feed, item.title, item.link
+		FROM item
+		JOIN user_item ON user_item.guid = item.guid
+		LEFT JOIN article ON article.guid = item.guid
+		WHERE article.guid IS NULL
+		AND (`+pendingCondition+` OR user_item.action = $1)
+		AND item.duplicate_of IS NULL
+		AND item.canonical <> ''
+	`, actionLater)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []feedItem
+	for rows.Next() {
+		var item feedItem
+		if err := rows.Scan(&item.GUID, &item.Feed, &item.Title, &item.Link); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// rescore updates the score of item for every account it is offered to.
+func rescore(st Store, classifier *classifier, item feedItem) error {
+	accounts, err := st.itemAccounts(item.GUID)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range accounts {
+		if err := st.setScore(id, item.GUID, classifier.classify(classifiableString(id, item))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// itemAccounts returns the accounts item is offered to.
+func (s *sqlStore) itemAccounts(guid string) ([]int64, error) {
+	rows, err := s.db.Query(`
+		SELECT account
+		FROM user_item
+		WHERE guid = $1
+	`, guid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, id)
+	}
+
+	return accounts, rows.Err()
+}
+
+// accountItem is an item offered to an account.
+type accountItem struct {
+	feedItem
+	Account int64
+}
+
+// unjudgedItems returns every item offered to an account which it has not
+// judged, with its article text.
+func (s *sqlStore) unjudgedItems() ([]accountItem, error) {
+	rows, err := s.db.Query(`
+		SELECT user_item.account, item.guid, item.title, item.feed, COALESCE(article.text, '')
+		FROM user_item
+		JOIN item ON item.guid = user_item.guid
+		LEFT JOIN article ON article.guid = item.guid
+		WHERE user_item.judgement IS NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []accountItem
+	for rows.Next() {
+		var item accountItem
+		if err := rows.Scan(&item.Account, &item.GUID, &item.Title, &item.Feed, &item.Text); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (s *sqlStore) setScore(accountID int64, guid string, score float64) error {
+	_, err := s.db.Exec(`
+		UPDATE user_item
+		SET score = $1
+		WHERE account = $2 AND guid = $3
+	`, score, accountID, guid)
+	return err
+}
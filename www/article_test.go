@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+func TestFetchArticles(t *testing.T) {
+	// The story is only served at its link as given: the canonical link
+	// reorders the query.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/story" || r.URL.RawQuery != "id=7&from=feed" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		http.ServeFile(w, r, "testdata/article.html")
+	}))
+	defer server.Close()
+
+	st := openTestStore(t)
+
+	link := server.URL + "/story?id=7&from=feed"
+	addTestAccount(t, st, "alice",
+		feedItem{GUID: "story", Feed: "f", Title: "Why the sky is blue", Link: link, Canonical: canonicalizeURL(link), Published: time.Now()},
+	)
+
+	if err := fetchArticles(context.Background(), &classifier{zeroMode: true}, st); err != nil {
+		t.Fatal(err)
+	}
+
+	a, ok, err := st.loadArticle("story")
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("No article was stored")
+	} else if !strings.Contains(a.Text, "Rayleigh") {
+		t.Errorf("Got article text %q, want the story's", a.Text)
+	}
+}
+
+func TestExtractArticle(t *testing.T) {
+	f, err := os.Open("testdata/article.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	root, err := html.Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := extractArticle(root)
+
+	paragraphs := a.Paragraphs()
+	if len(paragraphs) != 5 {
+		t.Fatalf("Got paragraphs %q, want the heading and the story's four", paragraphs)
+	}
+	if paragraphs[0] != "Why the sky is blue" {
+		t.Errorf("Got title %q, want Why the sky is blue", paragraphs[0])
+	}
+	for _, want := range []string{"Sunlight reaches the atmosphere", "Lord Rayleigh", "At sunset"} {
+		if !strings.Contains(a.Text, want) {
+			t.Errorf("Article text does not contain %q:\n%s", want, a.Text)
+		}
+	}
+
+	// The page around the story is left out.
+	for _, boilerplate := range []string{"Subscribe", "cookies", "Related stories", "rainbows", "Great article", "Copyright", "analytics", "font-family"} {
+		if strings.Contains(a.Text, boilerplate) {
+			t.Errorf("Article text contains %q:\n%s", boilerplate, a.Text)
+		}
+	}
+
+	if words := len(strings.Fields(a.Text)); a.WordCount != words {
+		t.Errorf("Got word count %d, want %d", a.WordCount, words)
+	}
+}
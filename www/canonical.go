@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/yhat/scrape"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Query parameters which only exist to track where a click came from and
+// never change which page is served.
+var trackingParams = map[string]bool{
+	"fbclid":               true,
+	"gclid":                true,
+	"dclid":                true,
+	"mc_cid":               true,
+	"mc_eid":               true,
+	"igshid":               true,
+	"yclid":                true,
+	"_hsenc":               true,
+	"_hsmi":                true,
+	"ref":                  true,
+	"ref_src":              true,
+	"ncid":                 true,
+	"cmpid":                true,
+	"feedType":             true,
+	"feedName":             true,
+	"__twitter_impression": true,
+}
+
+// canonicalizeURL normalizes link so that two links to the same story
+// compare equal.  It returns "" for links that are not absolute http(s)
+// URLs, which are never grouped with anything.
+func canonicalizeURL(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return ""
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return ""
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return ""
+	}
+	host = strings.TrimPrefix(host, "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+
+	values := u.Query()
+	for key := range values {
+		if strings.HasPrefix(key, "utm_") || trackingParams[key] {
+			delete(values, key)
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	query := make([]string, 0, len(keys))
+	for _, key := range keys {
+		vs := values[key]
+		sort.Strings(vs)
+		for _, v := range vs {
+			query = append(query, url.QueryEscape(key)+"="+url.QueryEscape(v))
+		}
+	}
+
+	path := strings.TrimRight(u.EscapedPath(), "/")
+
+	canonical := "https://" + host + path
+	if len(query) > 0 {
+		canonical += "?" + strings.Join(query, "&")
+	}
+
+	return canonical
+}
+
+var canonicalClient = &http.Client{Timeout: 20 * time.Second}
+
+// Pages fetched for what they link to or say are only read this far, so
+// that one huge page cannot take all the server's memory.  The parts that
+// matter come well before it.
+const maxPageBytes = 5 << 20
+
+// resolveCanonical fetches link and returns the canonicalized target of its
+// <link rel="canonical">, or the canonicalized link itself if the page does
+// not declare one.
+func resolveCanonical(link string) (string, error) {
+	fallback := canonicalizeURL(link)
+	if fallback == "" {
+		return "", nil
+	}
+
+	res, err := canonicalClient.Get(link)
+	if err != nil {
+		return fallback, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || !strings.Contains(res.Header.Get("Content-Type"), "html") {
+		return fallback, nil
+	}
+
+	root, err := html.Parse(io.LimitReader(res.Body, maxPageBytes))
+	if err != nil {
+		return fallback, err
+	}
+
+	linkElem, ok := scrape.Find(root, func(n *html.Node) bool {
+		return n.DataAtom == atom.Link && strings.EqualFold(scrape.Attr(n, "rel"), "canonical")
+	})
+	if !ok {
+		return fallback, nil
+	}
+
+	href, err := res.Request.URL.Parse(scrape.Attr(linkElem, "href"))
+	if err != nil {
+		return fallback, nil
+	}
+
+	if canonical := canonicalizeURL(href.String()); canonical != "" {
+		return canonical, nil
+	}
+
+	return fallback, nil
+}
+
+// groupDuplicates points every item that shares a canonical link with
+// another at the group's primary, the item with the smallest guid.  Every
+// account offered any copy of the story is offered the primary, which
+// stands for the group, and each account's judgement and action of the group
+// is copied onto its copies that have none yet.
+func (s *sqlStore) groupDuplicates() error {
+	log.Printf("Grouping duplicates...")
+	defer log.Printf("Done grouping duplicates")
+
+	rows, err := s.db.Query(`
+		SELECT canonical, guid, duplicate_of
+		FROM item
+		WHERE canonical IN (
+			SELECT canonical
+			FROM item
+			WHERE canonical <> ''
+			GROUP BY canonical
+			HAVING count(*) > 1
+		)
+		ORDER BY canonical, guid
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type member struct {
+		guid        string
+		duplicateOf sql.NullString
+	}
+
+	groups := make(map[string][]member)
+	for rows.Next() {
+		var canonical string
+		var m member
+		if err := rows.Scan(&canonical, &m.guid, &m.duplicateOf); err != nil {
+			return err
+		}
+		groups[canonical] = append(groups[canonical], m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, members := range groups {
+		primary := members[0].guid
+
+		for _, m := range members[1:] {
+			if m.duplicateOf.String == primary {
+				continue
+			}
+
+			if _, err := s.db.Exec(`
+				UPDATE item
+				SET duplicate_of = $1
+				WHERE guid = $2
+			`, primary, m.guid); err != nil {
+				return err
+			}
+		}
+
+		if members[0].duplicateOf.Valid {
+			if _, err := s.db.Exec(`
+				UPDATE item
+				SET duplicate_of = NULL
+				WHERE guid = $1
+			`, primary); err != nil {
+				return err
+			}
+		}
+
+		if _, err := s.db.Exec(`
+			INSERT INTO user_item (account, guid, score)
+			SELECT account, $1, max(score)
+			FROM user_item
+			WHERE guid IN (SELECT guid FROM item WHERE guid = $1 OR duplicate_of = $1)
+			GROUP BY account
+			ON CONFLICT (account, guid) DO NOTHING
+		`, primary); err != nil {
+			return err
+		}
+
+		if err := s.copyGroupJudgements(primary); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyGroupJudgements copies each account's judgement of the duplicate
+// group headed by primary onto the copies it has not judged.  An account
+// that judged several copies differently keeps the judgement of the copy
+// with the smallest guid.
+func (s *sqlStore) copyGroupJudgements(primary string) error {
+	rows, err := s.db.Query(`
+		SELECT account, judgement, action
+		FROM user_item
+		WHERE guid IN (SELECT guid FROM item WHERE guid = $1 OR duplicate_of = $1)
+		AND (judgement IS NOT NULL OR action IS NOT NULL)
+		ORDER BY account, guid
+	`, primary)
+	if err != nil {
+		return err
+	}
+
+	type judged struct {
+		account   int64
+		judgement sql.NullBool
+		action    sql.NullString
+	}
+
+	var accounts []judged
+	for rows.Next() {
+		var j judged
+		if err := rows.Scan(&j.account, &j.judgement, &j.action); err != nil {
+			rows.Close()
+			return err
+		}
+		if n := len(accounts); n > 0 && accounts[n-1].account == j.account {
+			continue
+		}
+		accounts = append(accounts, j)
+	}
+
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, j := range accounts {
+		if _, err := s.db.Exec(`
+			UPDATE user_item
+			SET judgement = $1, action = $2
+			WHERE account = $3
+			AND guid IN (SELECT guid FROM item WHERE guid = $4 OR duplicate_of = $4)
+			AND `+pendingCondition+`
+		`, j.judgement, j.action, j.account, primary); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
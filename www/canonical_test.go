@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalizeURL(t *testing.T) {
+	for _, test := range []struct {
+		link, want string
+	}{
+		{"https://example.com/story", "https://example.com/story"},
+		{"http://www.Example.COM/story/", "https://example.com/story"},
+		{"  https://example.com:443/story  ", "https://example.com/story"},
+		{"https://example.com:8080/story", "https://example.com:8080/story"},
+		{"https://example.com/story?utm_source=rss&utm_medium=feed", "https://example.com/story"},
+		{"https://example.com/story?fbclid=x&id=2&a=1", "https://example.com/story?a=1&id=2"},
+		{"https://example.com/story?id=2&id=1", "https://example.com/story?id=1&id=2"},
+		{"https://example.com/story#comments", "https://example.com/story"},
+		{"https://example.com/a%2Fb", "https://example.com/a%2Fb"},
+		{"https://example.com/Story", "https://example.com/Story"},
+		{"ftp://example.com/story", ""},
+		{"/story", ""},
+		{"https:///story", ""},
+		{"%", ""},
+	} {
+		if got := canonicalizeURL(test.link); got != test.want {
+			t.Errorf("canonicalizeURL(%q) = %q, want %q", test.link, got, test.want)
+		}
+	}
+}
+
+func TestResolveCanonical(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/amp/story":
+			fmt.Fprint(w, `<html><head><link rel="Canonical" href="/story?utm_source=amp"></head></html>`)
+		case "/plain":
+			fmt.Fprint(w, `<html><head><title>Plain</title></head></html>`)
+		case "/huge":
+			fmt.Fprint(w, strings.Repeat(" ", maxPageBytes))
+			fmt.Fprint(w, `<link rel="canonical" href="/hidden">`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	base := canonicalizeURL(server.URL)
+
+	for _, test := range []struct {
+		path, want string
+	}{
+		{"/amp/story", base + "/story"},
+		{"/plain", base + "/plain"},
+		{"/huge", base + "/huge"},
+		{"/missing", base + "/missing"},
+	} {
+		got, err := resolveCanonical(server.URL + test.path)
+		if err != nil {
+			t.Errorf("resolveCanonical(%s): %s", test.path, err)
+		} else if got != test.want {
+			t.Errorf("resolveCanonical(%s) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
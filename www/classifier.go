@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"regexp"
 	"strings"
+	"time"
 )
 
 var wordRe = regexp.MustCompile(`([a-zA-Z']+)`)
@@ -27,16 +28,61 @@ func preprocessString(title string) string {
 }
 
 type feedItem struct {
-	GUID  string
-	Feed  string
-	Link  string
-	Title string
-	Score float64
+	GUID      string
+	Feed      string
+	Link      string
+	Title     string
+	Score     float64
+	Canonical string
+	Published time.Time
+
+	// Text is the extracted article text, if it has been fetched.
+	Text string
+
+	// Feeds lists every feed the item's duplicate group was seen in.
+	Feeds []string
+
+	// Cluster names the item's group of near-duplicate stories, and
+	// ClusterSize counts its members.
+	Cluster     string
+	ClusterSize int
+
+	// Page is the ID of the index page the item is shown on, if any, and
+	// Explored is set if it is there for exploration rather than its score.
+	Page     string
+	Explored bool
+
+	// Base is prefixed to links to the site when the item is rendered
+	// outside of it, such as in an email.
+	Base string
+
+	// Reader is the account the item is rendered for, whose feed token
+	// signs its click link.
+	Reader account
 }
 
-func classifiableString(item feedItem) string {
+func classifiableString(accountID int64, item feedItem) string {
 	//title := preprocessString(item.title)
-	return fmt.Sprintf("%s %s", item.Feed, item.Title)
+	if words := strings.Fields(item.Text); len(words) > 0 {
+		if len(words) > articleFeatureWords {
+			words = words[:articleFeatureWords]
+		}
+		return userFeatures(accountID, fmt.Sprintf("%s %s %s", item.Feed, item.Title, strings.Join(words, " ")))
+	}
+	return userFeatures(accountID, fmt.Sprintf("%s %s", item.Feed, item.Title))
+}
+
+// userFeatures adds a copy of every word in features marked with the
+// account, so that the one model shared by all accounts learns both what
+// everyone likes and what each account likes in particular.  Must match
+// userFeatures in the trainer.
+func userFeatures(accountID int64, features string) string {
+	words := strings.Fields(features)
+	marked := make([]string, len(words))
+	for i, word := range words {
+		marked[i] = fmt.Sprintf("u%d_%s", accountID, word)
+	}
+	return features + " " + strings.Join(marked, " ")
 }
 
 type classifyReq struct {
@@ -46,21 +92,30 @@ type classifyReq struct {
 
 type classifier struct {
 	zeroMode   bool
+	fastText   string
+	model      string
 	classifyCh chan classifyReq
 	quitCh     chan struct{}
 	doneCh     chan error
 }
 
-func newClassifier() *classifier {
-	if _, err := os.Stat("model.bin"); os.IsNotExist(err) {
+// newClassifier runs the fastText binary at fastText with the model at
+// model, or scores everything 0 if there is no model yet.
+func newClassifier(fastText, model string) *classifier {
+	if _, err := os.Stat(model); os.IsNotExist(err) {
 		return &classifier{
 			zeroMode: true,
 		}
 	}
 
+	// serve reports how it exited on doneCh, which is buffered so that it
+	// can exit before anyone asks.
 	c := &classifier{
+		fastText:   fastText,
+		model:      model,
 		classifyCh: make(chan classifyReq),
 		quitCh:     make(chan struct{}),
+		doneCh:     make(chan error, 1),
 	}
 	go c.serve()
 	return c
@@ -79,13 +134,19 @@ func (c *classifier) classify(item string) float64 {
 	return <-done
 }
 
+// stop closes fastText's input and waits for it to exit, returning its error
+// or the one it exited with earlier.
 func (c *classifier) stop() error {
 	if c.zeroMode {
 		return nil
 	}
 
-	c.quitCh <- struct{}{}
-	return <-c.doneCh
+	select {
+	case c.quitCh <- struct{}{}:
+		return <-c.doneCh
+	case err := <-c.doneCh:
+		return err
+	}
 }
 
 func (c *classifier) serve() {
@@ -96,7 +157,7 @@ func (c *classifier) serve() {
 	}
 	defer os.RemoveAll(dir)
 
-	cmd := exec.Command("./fasttext", "predict-prob", "model.bin", "-")
+	cmd := exec.Command(c.fastText, "predict-prob", c.model, "-")
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		c.doneCh <- fmt.Errorf("Creating stderr pipe to classifier: %s", err)
@@ -136,7 +197,7 @@ func (c *classifier) serve() {
 		return
 	}
 
-	waitCh := make(chan error)
+	waitCh := make(chan error, 1)
 
 	go func() {
 		log.Printf("Waiting for classifier command to exit...")
@@ -161,6 +222,7 @@ func (c *classifier) serve() {
 		case <-c.quitCh:
 			if err := stdin.Close(); err != nil {
 				c.doneCh <- err
+				return
 			}
 
 			c.doneCh <- <-waitCh
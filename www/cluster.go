@@ -0,0 +1,187 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+const (
+	// Only items published this close together are considered for the same
+	// cluster; wire stories are rewritten over hours, not weeks.
+	clusterWindow = 48 * time.Hour
+
+	// Estimated Jaccard similarity of title shingles above which two items
+	// are treated as the same story.
+	clusterThreshold = 0.6
+
+	shingleSize   = 4
+	signatureSize = 64
+)
+
+type signature [signatureSize]uint64
+
+var signatureSeeds = func() [signatureSize]uint64 {
+	var seeds [signatureSize]uint64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range seeds {
+		x = splitmix(x)
+		seeds[i] = x
+	}
+	return seeds
+}()
+
+func splitmix(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// shingles hashes every run of shingleSize characters in text.
+func shingles(text string) []uint64 {
+	runes := []rune(text)
+	if len(runes) < shingleSize {
+		if len(runes) == 0 {
+			return nil
+		}
+		runes = append(runes, make([]rune, shingleSize-len(runes))...)
+	}
+
+	hashes := make([]uint64, 0, len(runes)-shingleSize+1)
+	for i := 0; i+shingleSize <= len(runes); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(string(runes[i : i+shingleSize])))
+		hashes = append(hashes, h.Sum64())
+	}
+	return hashes
+}
+
+// minhash computes the MinHash signature of the shingles of text.  It
+// returns false if text has no shingles to compare.
+func minhash(text string) (signature, bool) {
+	var sig signature
+
+	hashes := shingles(text)
+	if len(hashes) == 0 {
+		return sig, false
+	}
+
+	for i := range sig {
+		sig[i] = ^uint64(0)
+	}
+
+	for _, h := range hashes {
+		for i, seed := range signatureSeeds {
+			if v := splitmix(h ^ seed); v < sig[i] {
+				sig[i] = v
+			}
+		}
+	}
+
+	return sig, true
+}
+
+// similarity estimates the Jaccard similarity of the shingle sets behind two
+// signatures.
+func (s signature) similarity(o signature) float64 {
+	same := 0
+	for i := range s {
+		if s[i] == o[i] {
+			same++
+		}
+	}
+	return float64(same) / signatureSize
+}
+
+// clusterText is the text compared between items.  It is the title part of
+// classifiableString, stemmed, since every item in a feed shares the feed
+// name and comparing it would pull unrelated stories together.
+func clusterText(item feedItem) string {
+	return preprocessString(item.Title)
+}
+
+// clusterItems assigns every recently published item to a cluster of
+// near-duplicate stories.  A cluster is named by the guid of its earliest
+// item, and items already assigned to a cluster keep it.
+func clusterItems(st Store) error {
+	log.Printf("Clustering items...")
+	defer log.Printf("Done clustering items")
+
+	recent, err := st.clusterCandidates(time.Now().Add(-clusterWindow))
+	if err != nil {
+		return err
+	}
+
+	type clusterable struct {
+		item feedItem
+		sig  signature
+		ok   bool
+	}
+
+	items := make([]clusterable, len(recent))
+	for i, item := range recent {
+		items[i].item = item
+		items[i].sig, items[i].ok = minhash(clusterText(item))
+	}
+
+	for i := range items {
+		c := &items[i]
+		if c.item.Cluster != "" {
+			continue
+		}
+
+		cluster := c.item.GUID
+		if c.ok {
+			for _, earlier := range items[:i] {
+				if earlier.ok && c.sig.similarity(earlier.sig) >= clusterThreshold {
+					cluster = earlier.item.Cluster
+					break
+				}
+			}
+		}
+
+		c.item.Cluster = cluster
+
+		if err := st.setCluster(c.item.GUID, cluster); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clusterCandidates returns the items published after since which are not
+// duplicates, oldest first.  Items not yet in a cluster have no Cluster.
+func (s *sqlStore) clusterCandidates(since time.Time) ([]feedItem, error) {
+	rows, err := s.db.Query(`
+		SELECT guid, feed, title, COALESCE(cluster, '')
+		FROM item
+		WHERE published > $1 AND duplicate_of IS NULL
+		ORDER BY published, guid
+	`, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []feedItem
+	for rows.Next() {
+		var item feedItem
+		if err := rows.Scan(&item.GUID, &item.Feed, &item.Title, &item.Cluster); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (s *sqlStore) setCluster(guid, cluster string) error {
+	_, err := s.db.Exec(`
+		UPDATE item
+		SET cluster = $1
+		WHERE guid = $2
+	`, cluster, guid)
+	return err
+}
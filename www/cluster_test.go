@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMinhash(t *testing.T) {
+	title := clusterText(feedItem{Title: "Fed raises interest rates by a quarter point"})
+	reworded := clusterText(feedItem{Title: "Fed raises interest rates by a quarter point, again"})
+	other := clusterText(feedItem{Title: "New species of frog discovered in Madagascar"})
+
+	a, ok := minhash(title)
+	if !ok {
+		t.Fatal("No signature for a title")
+	}
+	b, _ := minhash(reworded)
+	c, _ := minhash(other)
+
+	if s := a.similarity(a); s != 1 {
+		t.Errorf("Got similarity %v of a title to itself, want 1", s)
+	}
+	if s := a.similarity(b); s < clusterThreshold {
+		t.Errorf("Got similarity %v of a reworded title, want at least %v", s, clusterThreshold)
+	}
+	if s := a.similarity(c); s >= clusterThreshold {
+		t.Errorf("Got similarity %v of different stories, want less than %v", s, clusterThreshold)
+	}
+
+	if _, ok := minhash(""); ok {
+		t.Error("Got a signature for no text")
+	}
+	if _, ok := minhash("ab"); !ok {
+		t.Error("Got no signature for text shorter than a shingle")
+	}
+}
+
+func TestClusterItems(t *testing.T) {
+	st := openTestStore(t)
+
+	now := time.Now()
+	for _, item := range []feedItem{
+		{GUID: "first", Feed: "f", Title: "Fed raises interest rates by a quarter point", Published: now.Add(-3 * time.Hour)},
+		{GUID: "second", Feed: "g", Title: "Fed raises interest rates by a quarter point, again", Published: now.Add(-2 * time.Hour)},
+		{GUID: "other", Feed: "g", Title: "New species of frog discovered in Madagascar", Published: now.Add(-time.Hour)},
+		{GUID: "old", Feed: "f", Title: "Fed raises interest rates by a quarter point", Published: now.Add(-2 * clusterWindow)},
+	} {
+		if _, err := st.insertItem(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := clusterItems(st); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := st.(*sqlStore).clusterCandidates(now.Add(-3 * clusterWindow))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"first": "first", "second": "first", "other": "other", "old": ""}
+	for _, item := range items {
+		if item.Cluster != want[item.GUID] {
+			t.Errorf("Got cluster %q for %s, want %q", item.Cluster, item.GUID, want[item.GUID])
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// command is a subcommand of www, such as "www feed add".  Each takes the
+// server's configuration flags and works on the same database and model as
+// the server.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string)
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "", "serve the site, refreshing feeds in the background", serveCommand},
+		{"migrate", "", "bring the database schema up to date", migrateCommand},
+		{"feed add", "name link", "add a feed and subscribe every account to it", feedAddCommand},
+		{"feed ls", "", "list the feeds", feedListCommand},
+		{"feed rm", "name", "remove a feed and every subscription to it", feedRemoveCommand},
+		{"refresh", "", "scrape the feeds once", refreshCommand},
+		{"rescore", "", "score every unjudged item again with the model", rescoreCommand},
+		{"train", "", "have the trainer train a candidate model", trainCommand},
+		{"export-judgements", "", "write every judgement and its item to stdout", exportJudgementsCommand},
+		{"import-judgements", "file", "merge exported judgements and items into the database", importJudgementsCommand},
+		{"import-opml", "file", "add the feeds in an OPML file", importOPMLCommand},
+		{"model ls", "", "list the candidate models", modelListCommand},
+		{"model promote", "name", "make a candidate the model the server loads", modelPromoteCommand},
+	}
+}
+
+func main() {
+	args := os.Args[1:]
+
+	// Without a command, www serves, as it did before it had commands.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		serveCommand(args)
+		return
+	}
+
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == c.name {
+			c.run(args[len(words):])
+			return
+		}
+	}
+
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Usage: www [command] [flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", c.name, c.args, c.summary)
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, `Run "www <command> -h" for the flags of a command.`)
+}
+
+// commandFlags returns the flag set of the command named name, which takes
+// the positional arguments args.
+func commandFlags(name, args string) *flag.FlagSet {
+	flags := flag.NewFlagSet("www "+name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: www %s [flags] %s\n", name, args)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseCommand loads the configuration from a command's flags and exits if
+// it is not given exactly n positional arguments.
+func parseCommand(flags *flag.FlagSet, args []string, n int) config {
+	cfg, err := loadConfig(flags, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flags.NArg() != n {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	return cfg
+}
+
+// openCommandStore opens the configured database, bringing its schema up to
+// date as the server would.
+func openCommandStore(cfg config) Store {
+	store, err := openStore(cfg.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := store.migrate(); err != nil {
+		log.Fatalf("Migrating database: %s", err)
+	}
+
+	return store
+}
+
+// stopClassifier stops a command's classifier, so that fastText exits
+// before the command does.
+func stopClassifier(classifier *classifier) {
+	if err := classifier.stop(); err != nil {
+		log.Fatalf("Stopping classifier: %s", err)
+	}
+}
+
+// addFeedForAll adds a feed and subscribes every account to it, as if it had
+// been there when they signed up.
+func addFeedForAll(st Store, classifier *classifier, name, link string) error {
+	if err := checkFeed(name, link); err != nil {
+		return err
+	}
+
+	exists, err := st.feedExists(name)
+	if err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("Feed %q already exists", name)
+	}
+
+	if err := st.addFeed(name, link); err != nil {
+		return err
+	}
+
+	accounts, err := st.accounts()
+	if err != nil {
+		return err
+	}
+
+	for _, a := range accounts {
+		if err := subscribe(st, classifier, a.ID, name); err != nil {
+			return fmt.Errorf("Subscribing %q to feed %q: %s", a.Name, name, err)
+		}
+	}
+
+	return nil
+}
+
+func feedAddCommand(args []string) {
+	flags := commandFlags("feed add", "name link")
+	cfg := parseCommand(flags, args, 2)
+
+	store := openCommandStore(cfg)
+	defer store.close()
+
+	classifier := newClassifier(cfg.Model.FastText, cfg.Model.Path)
+
+	if err := addFeedForAll(store, classifier, flags.Arg(0), flags.Arg(1)); err != nil {
+		log.Fatal(err)
+	}
+
+	stopClassifier(classifier)
+}
+
+func feedListCommand(args []string) {
+	flags := commandFlags("feed ls", "")
+	cfg := parseCommand(flags, args, 0)
+
+	store := openCommandStore(cfg)
+	defer store.close()
+
+	feeds, err := store.feeds()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sort.Slice(feeds, func(i, j int) bool { return feeds[i].Name < feeds[j].Name })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, f := range feeds {
+		fmt.Fprintf(w, "%s\t%s\n", f.Name, f.Link)
+	}
+	w.Flush()
+}
+
+func feedRemoveCommand(args []string) {
+	flags := commandFlags("feed rm", "name")
+	cfg := parseCommand(flags, args, 1)
+
+	store := openCommandStore(cfg)
+	defer store.close()
+
+	name := flags.Arg(0)
+	exists, err := store.feedExists(name)
+	if err != nil {
+		log.Fatal(err)
+	} else if !exists {
+		log.Fatalf("No feed named %q", name)
+	}
+
+	// Items already scraped from the feed are kept, along with their
+	// judgements.
+	if err := store.deleteFeed(name); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func refreshCommand(args []string) {
+	flags := commandFlags("refresh", "")
+	only := flags.String("feed", "", "refresh only the feed with this `name`")
+	cfg := parseCommand(flags, args, 0)
+
+	store := openCommandStore(cfg)
+	defer store.close()
+
+	feeds, err := store.feeds()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *only != "" {
+		var matched []feedSource
+		for _, f := range feeds {
+			if f.Name == *only {
+				matched = append(matched, f)
+			}
+		}
+		if len(matched) == 0 {
+			log.Fatalf("No feed named %q", *only)
+		}
+		feeds = matched
+	}
+
+	classifier := newClassifier(cfg.Model.FastText, cfg.Model.Path)
+
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+
+	// Nobody is listening for events outside the server.
+	if err := refreshFeeds(ctx, classifier, store, nil, feeds); err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.Refresh.FetchArticles {
+		if err := fetchArticles(ctx, classifier, store); err != nil {
+			log.Fatalf("Fetching articles: %s", err)
+		}
+	}
+
+	stopClassifier(classifier)
+}
+
+func rescoreCommand(args []string) {
+	flags := commandFlags("rescore", "")
+	cfg := parseCommand(flags, args, 0)
+
+	store := openCommandStore(cfg)
+	defer store.close()
+
+	classifier := newClassifier(cfg.Model.FastText, cfg.Model.Path)
+
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+
+	if err := updateScores(ctx, classifier, store); err != nil {
+		log.Fatal(err)
+	}
+
+	stopClassifier(classifier)
+}
+
+func trainCommand(args []string) {
+	flags := commandFlags("train", "")
+	promote := flags.Bool("promote", false, "promote the model once it is trained")
+	cfg := parseCommand(flags, args, 0)
+
+	candidate, err := train(cfg.Trainer, cfg.Model.Path)
+	if err != nil {
+		log.Fatalf("Training: %s", err)
+	}
+	fmt.Println(candidate)
+
+	if *promote {
+		if err := promoteModel(cfg.Model.Path, candidate); err != nil {
+			log.Fatalf("Promoting %s: %s", candidate, err)
+		}
+	}
+}
+
+func exportJudgementsCommand(args []string) {
+	flags := commandFlags("export-judgements", "")
+	format := flags.String("format", formatJSONL, "write `jsonl` or csv")
+	cfg := parseCommand(flags, args, 0)
+
+	store := openCommandStore(cfg)
+	defer store.close()
+
+	if err := exportJudgements(store, os.Stdout, *format); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func importJudgementsCommand(args []string) {
+	flags := commandFlags("import-judgements", "file")
+	format := flags.String("format", "", "read `jsonl` or csv, rather than going by the file's extension")
+	cfg := parseCommand(flags, args, 1)
+
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = formatJSONL
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			*format = formatCSV
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	store := openCommandStore(cfg)
+	defer store.close()
+
+	if err := importJudgements(store, f, *format); err != nil {
+		log.Fatalf("Importing %s: %s", path, err)
+	}
+}
+
+// opmlOutline is an outline in an OPML file, which is a feed if it has an
+// xmlUrl and otherwise may be a folder of them.
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr"`
+	XMLURL   string        `xml:"xmlUrl,attr"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+// opmlFeeds returns the feeds in outlines and the folders within them.
+func opmlFeeds(outlines []opmlOutline) []feedSource {
+	var feeds []feedSource
+	for _, o := range outlines {
+		if o.XMLURL != "" {
+			title := o.Title
+			if title == "" {
+				title = o.Text
+			}
+			feeds = append(feeds, feedSource{Name: opmlFeedName(title, o.XMLURL), Link: o.XMLURL})
+		}
+		feeds = append(feeds, opmlFeeds(o.Outlines)...)
+	}
+	return feeds
+}
+
+// opmlFeedName makes a feed name like the built-in ones, such as
+// "slate-star-codex", from a feed's title, or from its link's host if it has
+// none.
+func opmlFeedName(title, link string) string {
+	if title == "" {
+		if u, err := url.Parse(link); err == nil {
+			title = u.Host
+		}
+	}
+
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+func importOPMLCommand(args []string) {
+	flags := commandFlags("import-opml", "file")
+	cfg := parseCommand(flags, args, 1)
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	var doc struct {
+		Outlines []opmlOutline `xml:"body>outline"`
+	}
+	if err := xml.NewDecoder(f).Decode(&doc); err != nil {
+		log.Fatalf("Reading %s: %s", flags.Arg(0), err)
+	}
+
+	store := openCommandStore(cfg)
+	defer store.close()
+
+	existing, err := store.feeds()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names := make(map[string]bool)
+	links := make(map[string]bool)
+	for _, f := range existing {
+		names[f.Name] = true
+		links[f.Link] = true
+	}
+
+	classifier := newClassifier(cfg.Model.FastText, cfg.Model.Path)
+
+	// Feeds already there, by name or by link, are left as they are.
+	for _, feed := range opmlFeeds(doc.Outlines) {
+		if names[feed.Name] || links[feed.Link] {
+			log.Printf("Skipping %q, which is already a feed", feed.Link)
+			continue
+		}
+
+		if err := addFeedForAll(store, classifier, feed.Name, feed.Link); err != nil {
+			log.Printf("Adding %q: %s", feed.Link, err)
+			continue
+		}
+
+		names[feed.Name] = true
+		links[feed.Link] = true
+		fmt.Printf("%s\t%s\n", feed.Name, feed.Link)
+	}
+
+	stopClassifier(classifier)
+}
+
+func modelListCommand(args []string) {
+	flags := commandFlags("model ls", "")
+	cfg := parseCommand(flags, args, 0)
+
+	models, err := listModels(cfg.Model.Path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The live model, which the server loads, is marked with a star.
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, m := range models {
+		live := ""
+		if m.Live {
+			live = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", live, m.Path, m.Size, m.Modified.Format("2006-01-02 15:04:05"))
+	}
+	w.Flush()
+}
+
+func modelPromoteCommand(args []string) {
+	flags := commandFlags("model promote", "name")
+	cfg := parseCommand(flags, args, 1)
+
+	m, err := findModel(cfg.Model.Path, flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := promoteModel(cfg.Model.Path, m.Path); err != nil {
+		log.Fatalf("Promoting %s: %s", m.Path, err)
+	}
+
+	log.Printf("Promoted %s; restart the server to load it", m.Path)
+}
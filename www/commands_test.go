@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runCommand runs a command as www would and returns what it wrote to
+// stdout.
+func runCommand(t *testing.T, run func(args []string), args ...string) string {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+
+	run(args)
+
+	out, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+// commandTestDatabase returns the URL of a new SQLite database with an
+// account, for commands to be run against without a model.
+func commandTestDatabase(t *testing.T) (string, account) {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("config", "")
+	t.Setenv("model", filepath.Join(dir, "model.bin"))
+
+	database := "sqlite:" + filepath.Join(dir, "feed.db")
+	st, err := openStore(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+
+	if _, err := st.migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := createAccount(st, &classifier{zeroMode: true}, "alice", "password1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return database, a
+}
+
+// listedFeeds runs feed ls and returns the link of each feed it lists by
+// name.
+func listedFeeds(t *testing.T, database string) map[string]string {
+	t.Helper()
+
+	feeds := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(runCommand(t, feedListCommand, "-database", database)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Fatalf("feed ls wrote line %q, want a name and a link", line)
+		}
+		feeds[fields[0]] = fields[1]
+	}
+	return feeds
+}
+
+// subscribed returns whether the account subscribes to the feed.
+func subscribed(t *testing.T, database string, a account, feed string) bool {
+	t.Helper()
+
+	st, err := openStore(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+
+	subscriptions, err := st.listSubscriptions(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range subscriptions {
+		if s.Name == feed {
+			return s.Subscribed
+		}
+	}
+	return false
+}
+
+func TestFeedCommands(t *testing.T) {
+	database, a := commandTestDatabase(t)
+
+	if out := runCommand(t, feedAddCommand, "-database", database, "smbc", "https://www.smbc-comics.com/rss.php"); out != "" {
+		t.Errorf("feed add wrote %q", out)
+	}
+
+	feeds := listedFeeds(t, database)
+	if link := feeds["smbc"]; link != "https://www.smbc-comics.com/rss.php" {
+		t.Errorf("feed ls after adding smbc listed it with link %q", link)
+	}
+	if len(feeds) != 7 {
+		t.Errorf("feed ls listed %v, want smbc and the 6 default feeds", feeds)
+	}
+
+	if !subscribed(t, database, a, "smbc") {
+		t.Error("Existing account was not subscribed to the added feed")
+	}
+
+	runCommand(t, feedRemoveCommand, "-database", database, "smbc")
+
+	if feeds := listedFeeds(t, database); len(feeds) != 6 || feeds["smbc"] != "" {
+		t.Errorf("feed ls after removing smbc listed %v", feeds)
+	}
+	if subscribed(t, database, a, "smbc") {
+		t.Error("Subscription to the removed feed was kept")
+	}
+}
+
+func TestImportOPMLCommand(t *testing.T) {
+	database, a := commandTestDatabase(t)
+
+	opml := filepath.Join(t.TempDir(), "feeds.opml")
+	if err := os.WriteFile(opml, []byte(`<?xml version="1.0"?>
+<opml version="2.0">
+	<head><title>Subscriptions</title></head>
+	<body>
+		<outline text="Comics">
+			<outline text="SMBC" type="rss" xmlUrl="https://www.smbc-comics.com/rss.php"/>
+			<outline text="xkcd.com" type="rss" xmlUrl="http://xkcd.com/rss.xml"/>
+		</outline>
+		<outline type="rss" xmlUrl="https://blog.golang.org/feed.atom"/>
+	</body>
+</opml>
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// xkcd is already a default feed, so only the others are added.
+	out := runCommand(t, importOPMLCommand, "-database", database, opml)
+	if want := "smbc\thttps://www.smbc-comics.com/rss.php\nblog-golang-org\thttps://blog.golang.org/feed.atom\n"; out != want {
+		t.Errorf("import-opml wrote %q, want %q", out, want)
+	}
+
+	feeds := listedFeeds(t, database)
+	if len(feeds) != 8 || feeds["smbc"] == "" || feeds["blog-golang-org"] == "" {
+		t.Errorf("feed ls after importing listed %v, want smbc, blog-golang-org and the 6 default feeds", feeds)
+	}
+
+	if !subscribed(t, database, a, "blog-golang-org") {
+		t.Error("Existing account was not subscribed to the imported feed")
+	}
+
+	// Importing again adds nothing.
+	if out := runCommand(t, importOPMLCommand, "-database", database, opml); out != "" {
+		t.Errorf("Importing again wrote %q", out)
+	}
+}
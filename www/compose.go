@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// How many candidates the index page composes its items from, per item.
+const candidatesPerSlot = 20
+
+// How many of the best scoring candidates are reordered by the ranker.
+// Rankers only reorder items, so this bounds how far down the scores an item
+// can be promoted from.
+const rankingWindow = 500
+
+// candidateOrder is the order pendingCandidates returns candidates in.
+type candidateOrder int
+
+const (
+	// Best scoring first, ties broken by guid.
+	byScore candidateOrder = iota
+	// Shuffled, for picking items to explore.
+	atRandom
+)
+
+// pendingCandidates returns up to limit items the account has not judged
+// which may be shown on its index page, in the given order.  Of each
+// cluster of near-duplicate stories only the member scoring best for the
+// account is a candidate, and none once it has judged any of them.
+func (s *sqlStore) pendingCandidates(accountID int64, order candidateOrder, limit int) ([]feedItem, error) {
+	var orderBy string
+	switch order {
+	case byScore:
+		orderBy = `user_item.score DESC, item.guid`
+	case atRandom:
+		orderBy = `random()`
+	default:
+		return nil, fmt.Errorf("Unknown candidate order %d", order)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT item.guid, item.feed, item.title, item.link, user_item.score, item.published, COALESCE(article.text, ''), COALESCE(item.cluster, item.guid), (
+			SELECT count(*)
+			FROM item AS member
+			WHERE member.cluster = item.cluster AND member.duplicate_of IS NULL
+		)
+		FROM item
+		JOIN user_item ON user_item.guid = item.guid AND user_item.account = $1
+		LEFT JOIN article ON article.guid = item.guid
+		WHERE `+pendingCondition+` AND item.duplicate_of IS NULL AND NOT EXISTS (
+			SELECT 1
+			FROM item AS other
+			JOIN user_item AS other_user ON other_user.guid = other.guid AND other_user.account = $1
+			WHERE other.cluster = item.cluster
+			AND other.guid <> item.guid
+			AND other.duplicate_of IS NULL
+			AND (
+				other_user.judgement IS NOT NULL
+				OR other_user.action IS NOT NULL
+				OR other_user.score > user_item.score
+				OR (other_user.score = user_item.score AND other.guid < item.guid)
+			)
+		)
+		ORDER BY `+orderBy+`
+		LIMIT $2
+	`, accountID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := make([]feedItem, 0)
+	for rows.Next() {
+		var item feedItem
+
+		if err := rows.Scan(&item.GUID, &item.Feed, &item.Title, &item.Link, &item.Score, &item.Published, &item.Text, &item.Cluster, &item.ClusterSize); err != nil {
+			return nil, err
+		}
+
+		candidates = append(candidates, item)
+	}
+
+	return candidates, rows.Err()
+}
+
+// composePage picks up to size items for a page from candidates, which must
+// be ordered best first.  No feed gets more than perFeed items, and feeds
+// take turns so that the page mixes sources: first the best item of each
+// feed, in the order of those items, then the second best of each, and so
+// on.  elided counts the candidates which would have been shown if feeds
+// were not capped.
+func composePage(candidates []feedItem, size, perFeed int) (page []feedItem, elided int) {
+	var feeds []string
+	byFeed := make(map[string][]feedItem)
+	for _, item := range candidates {
+		if _, ok := byFeed[item.Feed]; !ok {
+			feeds = append(feeds, item.Feed)
+		}
+		byFeed[item.Feed] = append(byFeed[item.Feed], item)
+	}
+
+	page = make([]feedItem, 0, size)
+	shown := make(map[string]bool)
+
+	for round := 0; round < perFeed && len(page) < size; round++ {
+		for _, feed := range feeds {
+			if len(page) >= size {
+				break
+			}
+			if items := byFeed[feed]; round < len(items) {
+				page = append(page, items[round])
+				shown[items[round].GUID] = true
+			}
+		}
+	}
+
+	for i, item := range candidates {
+		if i >= size {
+			break
+		}
+		if !shown[item.GUID] {
+			elided++
+		}
+	}
+
+	return page, elided
+}
+
+// exploreSlots returns how many of size slots to give to exploration so
+// that, on average, fraction of them are.
+func exploreSlots(size int, fraction float64) int {
+	expected := fraction * float64(size)
+	n := int(expected)
+	if rand.Float64() < expected-float64(n) {
+		n++
+	}
+	if n > size {
+		n = size
+	}
+	return n
+}
+
+// addExploration inserts up to n items from pool into page at random
+// positions, marking them as explored.  Items are drawn without replacement
+// with probability proportional to how uncertain the classifier is about
+// them, so items scored near 0.5 are the most likely and confidently scored
+// ones still have a chance.
+func addExploration(page, pool []feedItem, n int) []feedItem {
+	onPage := make(map[string]bool)
+	for _, item := range page {
+		onPage[item.GUID] = true
+	}
+
+	var weights []float64
+	var choices []feedItem
+	for _, item := range pool {
+		if onPage[item.GUID] {
+			continue
+		}
+		choices = append(choices, item)
+		weights = append(weights, 1.05-2*math.Abs(item.Score-0.5))
+	}
+
+	for ; n > 0 && len(choices) > 0; n-- {
+		total := 0.0
+		for _, w := range weights {
+			total += w
+		}
+
+		i := 0
+		for r := rand.Float64() * total; i < len(weights)-1; i++ {
+			r -= weights[i]
+			if r < 0 {
+				break
+			}
+		}
+
+		item := choices[i]
+		item.Explored = true
+
+		choices = append(choices[:i], choices[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+
+		at := rand.Intn(len(page) + 1)
+		page = append(page, feedItem{})
+		copy(page[at+1:], page[at:])
+		page[at] = item
+	}
+
+	return page
+}
+
+// recordImpressions records which items were shown to the account on page,
+// which of them were there for exploration, and which ranker ordered them.
+func (s *sqlStore) recordImpressions(accountID int64, page string, items []feedItem, rankerName string) error {
+	now := time.Now().UTC()
+	for i, item := range items {
+		if _, err := s.db.Exec(`
+			INSERT INTO impression (account, page, guid, position, explored, ranker, created)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, accountID, page, item.GUID, i, item.Explored, rankerName, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
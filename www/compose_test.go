@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestComposePage(t *testing.T) {
+	candidates := []feedItem{
+		{GUID: "a1", Feed: "a"},
+		{GUID: "a2", Feed: "a"},
+		{GUID: "a3", Feed: "a"},
+		{GUID: "b1", Feed: "b"},
+		{GUID: "a4", Feed: "a"},
+		{GUID: "c1", Feed: "c"},
+		{GUID: "b2", Feed: "b"},
+	}
+
+	for _, test := range []struct {
+		size, perFeed int
+		want          []string
+		elided        int
+	}{
+		// Feeds take turns in the order of their best items.
+		{5, 2, []string{"a1", "b1", "c1", "a2", "b2"}, 2},
+		{3, 2, []string{"a1", "b1", "c1"}, 2},
+		{10, 1, []string{"a1", "b1", "c1"}, 4},
+		{10, 10, []string{"a1", "b1", "c1", "a2", "b2", "a3", "a4"}, 0},
+		{0, 2, []string{}, 0},
+	} {
+		page, elided := composePage(candidates, test.size, test.perFeed)
+		if !sameGUIDs(page, test.want...) {
+			t.Errorf("composePage(%d, %d) = %v, want %v", test.size, test.perFeed, guids(page), test.want)
+		}
+		if elided != test.elided {
+			t.Errorf("composePage(%d, %d) elided %d, want %d", test.size, test.perFeed, elided, test.elided)
+		}
+	}
+}
+
+func TestExploreSlots(t *testing.T) {
+	if n := exploreSlots(10, 0); n != 0 {
+		t.Errorf("Got %d slots for no exploration, want 0", n)
+	}
+	if n := exploreSlots(10, 1); n != 10 {
+		t.Errorf("Got %d slots for only exploration, want 10", n)
+	}
+	if n := exploreSlots(10, 2); n != 10 {
+		t.Errorf("Got %d slots for more exploration than slots, want 10", n)
+	}
+
+	// A fraction of a slot is rounded up as often as it is worth.
+	const trials = 10000
+	total := 0
+	for i := 0; i < trials; i++ {
+		n := exploreSlots(10, 0.15)
+		if n != 1 && n != 2 {
+			t.Fatalf("Got %d slots for 1.5 expected, want 1 or 2", n)
+		}
+		total += n
+	}
+	if mean := float64(total) / trials; mean < 1.45 || mean > 1.55 {
+		t.Errorf("Got %v slots on average, want 1.5", mean)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is everything the server can be configured with.  Settings come
+// from the defaults in defaultConfig, then the TOML file named by -config or
+// the config environment variable, then environment variables, then flags,
+// each overriding the last.
+type config struct {
+	Database      string `toml:"database"`
+	Listen        string `toml:"listen"`
+	BaseURL       string `toml:"base_url"`
+	Template      string `toml:"template"`
+	TLSCert       string `toml:"tls_cert"`
+	TLSKey        string `toml:"tls_key"`
+	SecureCookies bool   `toml:"secure_cookies"`
+	AllowSignup   bool   `toml:"allow_signup"`
+	Admins        string `toml:"admins"`
+
+	Model struct {
+		FastText string `toml:"fasttext"`
+		Path     string `toml:"path"`
+	} `toml:"model"`
+
+	Trainer trainerConfig `toml:"trainer"`
+
+	Refresh struct {
+		Interval      duration `toml:"interval"`
+		FetchArticles bool     `toml:"fetch_articles"`
+	} `toml:"refresh"`
+
+	Index struct {
+		PageSize        int      `toml:"page_size"`
+		MaxPerFeed      int      `toml:"max_per_feed"`
+		ExploreFraction float64  `toml:"explore_fraction"`
+		Ranker          string   `toml:"ranker"`
+		DecayHalfLife   duration `toml:"decay_half_life"`
+		FeedBoosts      string   `toml:"feed_boosts"`
+	} `toml:"index"`
+
+	Archive struct {
+		Dir      string `toml:"dir"`
+		MaxBytes size   `toml:"max_bytes"`
+	} `toml:"archive"`
+
+	Out struct {
+		Threshold float64 `toml:"threshold"`
+		TopPerDay int     `toml:"top_per_day"`
+	} `toml:"out"`
+
+	Events struct {
+		Threshold float64 `toml:"threshold"`
+	} `toml:"events"`
+
+	Digest struct {
+		SMTPAddr     string   `toml:"smtp_addr"`
+		SMTPUser     string   `toml:"smtp_user"`
+		SMTPPassword string   `toml:"smtp_password"`
+		From         string   `toml:"from"`
+		Interval     duration `toml:"interval"`
+		Size         int      `toml:"size"`
+	} `toml:"digest"`
+}
+
+// trainerConfig is how to reach the trainer and authenticate to it.
+type trainerConfig struct {
+	URL        string `toml:"url"`
+	Secret     string `toml:"secret"`
+	ClientCert string `toml:"client_cert"`
+	ClientKey  string `toml:"client_key"`
+	CA         string `toml:"ca"`
+}
+
+// duration is a time.Duration written as a string like "3h" in the file.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// size is a number of bytes written like "1G" in the file.
+type size int64
+
+func (s *size) UnmarshalText(text []byte) error {
+	n, err := parseSize(string(text))
+	*s = size(n)
+	return err
+}
+
+func defaultConfig() config {
+	var c config
+	c.Database = "postgresql://feed@10.0.1.1:26257/feed?sslmode=disable"
+	c.Template = "template.html"
+	c.Model.FastText = "./fasttext"
+	c.Model.Path = "model.bin"
+	c.Trainer.URL = "http://10.0.2.1"
+	c.Refresh.Interval.Duration = 3 * time.Hour
+	c.Index.PageSize = 3
+	c.Index.MaxPerFeed = 1
+	c.Index.ExploreFraction = 0.1
+	c.Index.Ranker = "score"
+	c.Index.DecayHalfLife.Duration = 24 * time.Hour
+	c.Archive.MaxBytes = 1 << 30
+	c.Out.Threshold = 0.5
+	c.Events.Threshold = 0.5
+	c.Digest.Interval.Duration = 24 * time.Hour
+	c.Digest.Size = 10
+	return c
+}
+
+// loadConfig builds the configuration from args and the environment, and
+// checks it.  Errors name the setting at fault.  The configuration flags are
+// added to flags, which may already have flags of the command's own.  Flags
+// are named like the environment variables, and cover the settings that
+// differ between runs of the commands; the rest are set in the file or the
+// environment.
+func loadConfig(flags *flag.FlagSet, args []string) (config, error) {
+	c := defaultConfig()
+
+	path := flags.String("config", os.Getenv("config"), "TOML configuration `file`")
+	database := flags.String("database", "", "database connection `URL`")
+	listen := flags.String("listen", "", "`address` to serve on")
+	baseURL := flags.String("base_url", "", "`URL` the site is served at, for links in feeds and email")
+	templ := flags.String("template", "", "HTML template `file`")
+	model := flags.String("model", "", "fastText model `file`")
+	refreshInterval := flags.Duration("refresh_interval", 0, "how often to scrape the feeds")
+	if err := flags.Parse(args); err != nil {
+		return c, err
+	}
+
+	if *path != "" {
+		if _, err := toml.DecodeFile(*path, &c); err != nil {
+			return c, fmt.Errorf("Reading %s: %s", *path, err)
+		}
+	}
+
+	if err := c.fromEnv(); err != nil {
+		return c, err
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "database":
+			c.Database = *database
+		case "listen":
+			c.Listen = *listen
+		case "base_url":
+			c.BaseURL = *baseURL
+		case "template":
+			c.Template = *templ
+		case "model":
+			c.Model.Path = *model
+		case "refresh_interval":
+			c.Refresh.Interval.Duration = *refreshInterval
+		}
+	})
+
+	return c, c.validate()
+}
+
+// fromEnv applies the environment variables that are set.  Their names are
+// the ones the server was configured with before it had a file.
+func (c *config) fromEnv() error {
+	e := envReader{}
+
+	e.string("database_url", &c.Database)
+	e.string("host", &c.Listen)
+	e.string("base_url", &c.BaseURL)
+	e.string("template", &c.Template)
+	e.string("tls_cert", &c.TLSCert)
+	e.string("tls_key", &c.TLSKey)
+	e.bool("secure_cookies", &c.SecureCookies)
+	e.bool("allow_signup", &c.AllowSignup)
+	e.string("admins", &c.Admins)
+
+	e.string("fasttext", &c.Model.FastText)
+	e.string("model", &c.Model.Path)
+
+	e.string("train_url", &c.Trainer.URL)
+	e.string("train_secret", &c.Trainer.Secret)
+	e.string("train_client_cert", &c.Trainer.ClientCert)
+	e.string("train_client_key", &c.Trainer.ClientKey)
+	e.string("train_ca", &c.Trainer.CA)
+
+	e.duration("refresh_interval", &c.Refresh.Interval)
+	e.bool("fetch_articles", &c.Refresh.FetchArticles)
+
+	e.int("page_size", &c.Index.PageSize)
+	e.int("max_per_feed", &c.Index.MaxPerFeed)
+	e.float("explore_fraction", &c.Index.ExploreFraction)
+	e.string("ranker", &c.Index.Ranker)
+	e.duration("decay_half_life", &c.Index.DecayHalfLife)
+	e.string("feed_boosts", &c.Index.FeedBoosts)
+
+	e.string("archive_dir", &c.Archive.Dir)
+	e.size("archive_max_bytes", &c.Archive.MaxBytes)
+
+	e.float("out_threshold", &c.Out.Threshold)
+	e.int("out_top_per_day", &c.Out.TopPerDay)
+
+	e.float("events_threshold", &c.Events.Threshold)
+
+	e.string("smtp_addr", &c.Digest.SMTPAddr)
+	e.string("smtp_user", &c.Digest.SMTPUser)
+	e.string("smtp_password", &c.Digest.SMTPPassword)
+	e.string("digest_from", &c.Digest.From)
+	e.duration("digest_interval", &c.Digest.Interval)
+	e.int("digest_size", &c.Digest.Size)
+
+	return e.err
+}
+
+// validate reports every setting that is out of range at once, so that a
+// bad configuration can be fixed in one go.
+func (c *config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Database != "", "database must be set")
+	check(c.Template != "", "template must be set")
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls_cert and tls_key must be set together")
+	check(c.Model.FastText != "" && c.Model.Path != "", "model.fasttext and model.path must be set")
+	check((c.Trainer.ClientCert == "") == (c.Trainer.ClientKey == ""), "trainer.client_cert and trainer.client_key must be set together")
+	check(c.Refresh.Interval.Duration > 0, "refresh.interval must be positive, not %s", c.Refresh.Interval)
+	check(c.Index.PageSize > 0, "index.page_size must be positive, not %d", c.Index.PageSize)
+	check(c.Index.MaxPerFeed > 0, "index.max_per_feed must be positive, not %d", c.Index.MaxPerFeed)
+	check(c.Index.ExploreFraction >= 0 && c.Index.ExploreFraction <= 1, "index.explore_fraction must be between 0 and 1, not %g", c.Index.ExploreFraction)
+	check(c.Index.DecayHalfLife.Duration > 0, "index.decay_half_life must be positive, not %s", c.Index.DecayHalfLife)
+	check(c.Archive.MaxBytes > 0, "archive.max_bytes must be positive, not %d", c.Archive.MaxBytes)
+	check(c.Out.Threshold >= 0 && c.Out.Threshold <= 1, "out.threshold must be between 0 and 1, not %g", c.Out.Threshold)
+	check(c.Events.Threshold >= 0 && c.Events.Threshold <= 1, "events.threshold must be between 0 and 1, not %g", c.Events.Threshold)
+	check(c.Out.TopPerDay >= 0, "out.top_per_day must not be negative, not %d", c.Out.TopPerDay)
+
+	if _, ok := newRankers(0, nil)[c.Index.Ranker]; !ok {
+		var names []string
+		for name := range newRankers(0, nil) {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		problems = append(problems, fmt.Sprintf("index.ranker must be one of %s, not %q", strings.Join(names, ", "), c.Index.Ranker))
+	}
+
+	if _, err := parseFeedBoosts(c.Index.FeedBoosts); err != nil {
+		problems = append(problems, fmt.Sprintf("index.feed_boosts: %s", err))
+	}
+
+	if c.Digest.SMTPAddr != "" {
+		check(c.BaseURL != "" && c.Digest.From != "", "sending digests needs base_url and digest.from")
+		check(c.Digest.Interval.Duration > 0, "digest.interval must be positive, not %s", c.Digest.Interval)
+		check(c.Digest.Size > 0, "digest.size must be positive, not %d", c.Digest.Size)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid configuration:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// envReader reads typed environment variables, keeping the first error.
+// Unset and empty variables leave their setting alone.
+type envReader struct {
+	err error
+}
+
+func (e *envReader) lookup(name string) (string, bool) {
+	s := os.Getenv(name)
+	return s, s != "" && e.err == nil
+}
+
+func (e *envReader) fail(name, s, what string) {
+	e.err = fmt.Errorf("Parsing %s: %q is not %s", name, s, what)
+}
+
+func (e *envReader) string(name string, v *string) {
+	if s, ok := e.lookup(name); ok {
+		*v = s
+	}
+}
+
+func (e *envReader) bool(name string, v *bool) {
+	if s, ok := e.lookup(name); ok {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			e.fail(name, s, "a boolean")
+		}
+		*v = b
+	}
+}
+
+func (e *envReader) int(name string, v *int) {
+	if s, ok := e.lookup(name); ok {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			e.fail(name, s, "a whole number")
+		}
+		*v = n
+	}
+}
+
+func (e *envReader) float(name string, v *float64) {
+	if s, ok := e.lookup(name); ok {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			e.fail(name, s, "a number")
+		}
+		*v = f
+	}
+}
+
+func (e *envReader) duration(name string, v *duration) {
+	if s, ok := e.lookup(name); ok {
+		if err := v.UnmarshalText([]byte(s)); err != nil {
+			e.fail(name, s, "a duration")
+		}
+	}
+}
+
+func (e *envReader) size(name string, v *size) {
+	if s, ok := e.lookup(name); ok {
+		if err := v.UnmarshalText([]byte(s)); err != nil {
+			e.fail(name, s, "a size")
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigEnvBool(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  bool
+		ok    bool
+	}{
+		{"true", true, true},
+		{"1", true, true},
+		{"false", false, true},
+		{"0", false, true},
+		{"yes", false, false},
+		{"flase", false, false},
+	} {
+		t.Setenv("secure_cookies", test.value)
+
+		c, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+		if !test.ok {
+			if err == nil || !strings.Contains(err.Error(), "secure_cookies") {
+				t.Errorf("Got error %v for secure_cookies=%q, want one naming it", err, test.value)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Loading secure_cookies=%q: %s", test.value, err)
+		} else if c.SecureCookies != test.want {
+			t.Errorf("Got secure_cookies %v for %q, want %v", c.SecureCookies, test.value, test.want)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, test := range []struct {
+		setting, value string
+		problem        string
+	}{
+		{"ranker", "decay", ""},
+		{"ranker", "boost", ""},
+		{"ranker", "random", "index.ranker"},
+		{"feed_boosts", "xkcd=2", ""},
+		{"feed_boosts", "xkcd", "index.feed_boosts"},
+		{"out_threshold", "0.9", ""},
+		{"out_threshold", "1.5", "out.threshold"},
+		{"events_threshold", "-0.1", "events.threshold"},
+	} {
+		t.Run(test.setting+"="+test.value, func(t *testing.T) {
+			t.Setenv(test.setting, test.value)
+
+			_, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+			if test.problem == "" && err != nil {
+				t.Errorf("Got error %s", err)
+			} else if test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)) {
+				t.Errorf("Got error %v, want one naming %s", err, test.problem)
+			}
+		})
+	}
+}
+
+func TestConfigFlags(t *testing.T) {
+	t.Setenv("base_url", "https://env.example")
+	t.Setenv("refresh_interval", "1h")
+
+	c, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+		"-base_url", "https://flag.example",
+		"-template", "other.html",
+		"-model", "other.bin",
+		"-refresh_interval", "10m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags override the environment.
+	if c.BaseURL != "https://flag.example" {
+		t.Errorf("Got base_url %q, want the flag's", c.BaseURL)
+	}
+	if c.Template != "other.html" {
+		t.Errorf("Got template %q, want the flag's", c.Template)
+	}
+	if c.Model.Path != "other.bin" {
+		t.Errorf("Got model %q, want the flag's", c.Model.Path)
+	}
+	if c.Refresh.Interval.Duration != 10*time.Minute {
+		t.Errorf("Got refresh_interval %s, want the flag's", c.Refresh.Interval.Duration)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// Forms posted with a session cookie carry the request's CSRF token in this
+// field, and scripts send it in csrfHeader.
+const (
+	csrfField  = "csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfToken is derived from the session cookie, so it changes with every
+// login and needs nothing stored.  It is "" for requests without a session.
+func csrfToken(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(cookie.Value))
+	mac.Write([]byte("csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkCSRF reports whether a request authenticated by session cookie may
+// change anything: only GET, HEAD and OPTIONS may leave out the CSRF token.
+func checkCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	want := csrfToken(r)
+	if want == "" {
+		return false
+	}
+
+	got := r.Header.Get(csrfHeader)
+	if got == "" {
+		got = r.PostFormValue(csrfField)
+	}
+
+	return hmac.Equal([]byte(got), []byte(want))
+}
+
+// parsePost parses the form of a request that changes something.  Only POSTs
+// may, since checkCSRF lets other methods through, and only the posted form
+// is read, so nothing can be smuggled in through the query string.
+func parsePost(r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return clientError(http.StatusMethodNotAllowed, "Method not allowed")
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return clientError(http.StatusBadRequest, "Invalid form: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// digest periodically emails every account with an email address the best
+// items it has not judged that arrived since its last digest.  Items sent are
+// recorded in digest_item so no item is sent to an account twice.
+type digest struct {
+	store    Store
+	templ    *template.Template
+	baseURL  string
+	interval time.Duration
+	size     int
+
+	smtpAddr     string
+	smtpUser     string
+	smtpPassword string
+	from         string
+}
+
+// How often to check whether a digest is due.  Due-ness is decided from the
+// time of the last digest in the database, so restarts do not reset it.
+const digestCheckInterval = 10 * time.Minute
+
+// run sends digests as they come due until ctx is done.
+func (d *digest) run(ctx context.Context) {
+	t := time.NewTicker(digestCheckInterval)
+	defer t.Stop()
+
+	for {
+		accounts, err := d.store.accountsWithEmail()
+		if err != nil {
+			log.Printf("Listing digest recipients: %s", err)
+		}
+
+		for _, a := range accounts {
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err := d.sendIfDue(a); err != nil {
+				log.Printf("Sending digest to %q: %s", a.Name, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (d *digest) sendIfDue(a account) error {
+	last, ok, err := d.store.lastDigest(a.ID)
+	if err != nil {
+		return err
+	}
+
+	if ok && time.Since(last) < d.interval {
+		return nil
+	}
+
+	if !ok {
+		last = time.Now().Add(-d.interval)
+	}
+
+	return d.send(a, last)
+}
+
+// send emails the account the best items it has not judged published since,
+// which have not been in one of its digests before.  Nothing is sent if there
+// are no such items.
+func (d *digest) send(a account, since time.Time) error {
+	items, err := d.store.digestItems(a.ID, since, d.size)
+	if err != nil {
+		return err
+	}
+
+	if len(items) == 0 {
+		log.Printf("No items for digest to %q since %s", a.Name, since)
+		return nil
+	}
+
+	for i := range items {
+		items[i].Base = d.baseURL
+		items[i].Reader = a
+		items[i].Feeds, err = d.store.itemFeeds(items[i].GUID)
+		if err != nil {
+			return err
+		}
+	}
+
+	message, err := d.compose(a, items)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if d.smtpUser != "" {
+		host := d.smtpAddr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", d.smtpUser, d.smtpPassword, host)
+	}
+
+	// The digest is recorded before it is sent, so that a failure to record
+	// it cannot send the same items again at the next check.  It is
+	// forgotten again if sending fails, to be retried.
+	id, err := d.store.recordDigest(a.ID, items, time.Now())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Sending digest of %d items to %q", len(items), a.Name)
+
+	if err := smtp.SendMail(d.smtpAddr, auth, d.from, []string{a.Email}, message); err != nil {
+		if err := d.store.forgetDigest(a.ID, id); err != nil {
+			log.Printf("Forgetting unsent digest to %q: %s", a.Name, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// lastDigest returns when the account was last sent a digest, or false if
+// it never has been.
+func (s *sqlStore) lastDigest(accountID int64) (time.Time, bool, error) {
+	var last time.Time
+	err := s.db.QueryRow(`
+		SELECT sent
+		FROM digest
+		WHERE account = $1
+		ORDER BY sent DESC
+		LIMIT 1
+	`, accountID).Scan(&last)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+	return last, true, nil
+}
+
+// digestItems returns up to limit of the best items the account has not
+// judged that were published after since and have not been in one of its
+// digests.
+func (s *sqlStore) digestItems(accountID int64, since time.Time, limit int) ([]feedItem, error) {
+	rows, err := s.db.Query(`
+		SELECT item.guid, item.feed, item.title, item.link, user_item.score
+		FROM item
+		JOIN user_item ON user_item.guid = item.guid AND user_item.account = $1
+		LEFT JOIN digest_item ON digest_item.guid = item.guid AND digest_item.account = $1
+		WHERE `+pendingCondition+`
+		AND item.duplicate_of IS NULL
+		AND item.published > $2
+		AND digest_item.guid IS NULL
+		ORDER BY user_item.score DESC
+		LIMIT $3
+	`, accountID, since.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]feedItem, 0)
+	for rows.Next() {
+		var item feedItem
+		if err := rows.Scan(&item.GUID, &item.Feed, &item.Title, &item.Link, &item.Score); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// recordDigest records that items were sent to the account, and returns
+// the ID of the digest.
+func (s *sqlStore) recordDigest(accountID int64, items []feedItem, sent time.Time) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	if err := tx.QueryRow(`
+		INSERT INTO digest (account, sent)
+		VALUES ($1, $2)
+		RETURNING id
+	`, accountID, sent.UTC()).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	for _, item := range items {
+		if _, err := tx.Exec(`
+			INSERT INTO digest_item (account, guid, digest)
+			VALUES ($1, $2, $3)
+		`, accountID, item.GUID, id); err != nil {
+			return 0, err
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+// forgetDigest deletes the account's digest id and the record of its items,
+// which were not sent after all.
+func (s *sqlStore) forgetDigest(accountID, id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DELETE FROM digest_item
+		WHERE account = $1 AND digest = $2
+	`, accountID, id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		DELETE FROM digest
+		WHERE account = $1 AND id = $2
+	`, accountID, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// compose renders items as a multipart email with plain text and HTML
+// alternatives, the HTML rendered with the same templates as the site.
+func (d *digest) compose(a account, items []feedItem) ([]byte, error) {
+	var text bytes.Buffer
+	for _, item := range items {
+		fmt.Fprintf(&text, "%s (%.1f)\n%s\n%s\n\n", strings.Join(item.Feeds, ", "), item.Score, item.Title, item.ClickURL())
+	}
+
+	var html bytes.Buffer
+	if err := d.templ.ExecuteTemplate(&html, "digest", struct {
+		Items []feedItem
+		Base  string
+	}{
+		Items: items,
+		Base:  d.baseURL,
+	}); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	for _, alternative := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	} {
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {alternative.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(part)
+		if _, err := qp.Write(alternative.content); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", d.from)
+	fmt.Fprintf(&message, "To: %s\r\n", a.Email)
+	fmt.Fprintf(&message, "Subject: %d new items\r\n", len(items))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%s\r\n", parts.Boundary())
+	fmt.Fprintf(&message, "\r\n")
+	message.Write(body.Bytes())
+
+	return message.Bytes(), nil
+}
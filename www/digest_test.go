@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpServer accepts mail on a local port, speaking just enough SMTP for
+// smtp.SendMail, and delivers each message's data to messages.
+type smtpServer struct {
+	listener net.Listener
+	messages chan []byte
+}
+
+func startSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &smtpServer{listener: l, messages: make(chan []byte, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost ESMTP")
+
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+
+		switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 localhost")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			data, err := io.ReadAll(c.DotReader())
+			if err != nil {
+				return
+			}
+			s.messages <- data
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("502 Unknown command %s", verb)
+		}
+	}
+}
+
+func TestDigestSend(t *testing.T) {
+	st := openTestStore(t)
+	server := startSMTPServer(t)
+
+	now := time.Now()
+	long := "A title long enough that quoted-printable has to wrap it across more than one line, café"
+	a := addTestAccount(t, st, "alice",
+		feedItem{GUID: "best", Feed: "f", Title: long, Link: "https://example.com/best", Published: now, Score: 0.9},
+		feedItem{GUID: "good", Feed: "f", Title: "Good", Link: "https://example.com/good", Published: now, Score: 0.6},
+	)
+
+	d := &digest{
+		store:    st,
+		templ:    template.Must(template.ParseFiles("template.html")),
+		baseURL:  "https://feed.example",
+		interval: 24 * time.Hour,
+		size:     10,
+		smtpAddr: server.listener.Addr().String(),
+		from:     "feed@feed.example",
+	}
+
+	since := now.Add(-time.Hour)
+	if err := d.send(a, since); err != nil {
+		t.Fatal(err)
+	}
+
+	var data []byte
+	select {
+	case data = <-server.messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No digest was received")
+	}
+
+	m, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to := m.Header.Get("To"); to != a.Email {
+		t.Errorf("Got To %q, want %q", to, a.Email)
+	}
+	if subject := m.Header.Get("Subject"); subject != "2 new items" {
+		t.Errorf("Got Subject %q, want 2 new items", subject)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	} else if mediaType != "multipart/alternative" {
+		t.Fatalf("Got Content-Type %s, want multipart/alternative", mediaType)
+	}
+
+	bodies := make(map[string]string)
+	parts := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		// NextRawPart leaves the transfer encoding for us to check.
+		part, err := parts.NextRawPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		contentType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding := part.Header.Get("Content-Transfer-Encoding"); encoding != "quoted-printable" {
+			t.Errorf("Got %s part encoded as %q, want quoted-printable", contentType, encoding)
+		}
+
+		raw, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(strings.NewReader(string(raw)))
+		for scanner.Scan() {
+			if len(scanner.Text()) > 76 {
+				t.Errorf("Got %s line of %d characters, longer than quoted-printable allows", contentType, len(scanner.Text()))
+			}
+		}
+
+		decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(string(raw))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies[contentType] = string(decoded)
+	}
+
+	items := []feedItem{
+		{GUID: "best", Base: d.baseURL, Reader: a},
+		{GUID: "good", Base: d.baseURL, Reader: a},
+	}
+
+	text, ok := bodies["text/plain"]
+	if !ok {
+		t.Fatal("Digest has no text/plain part")
+	}
+	for _, want := range []string{long, "Good", items[0].ClickURL(), items[1].ClickURL()} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text/plain part does not contain %q:\n%s", want, text)
+		}
+	}
+
+	html, ok := bodies["text/html"]
+	if !ok {
+		t.Fatal("Digest has no text/html part")
+	}
+	for _, want := range []string{long, "Good", template.HTMLEscapeString(items[0].ClickURL())} {
+		if !strings.Contains(html, want) {
+			t.Errorf("text/html part does not contain %q:\n%s", want, html)
+		}
+	}
+
+	// Sent items are recorded, so the same items are not sent again.
+	if err := d.send(a, since); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nor is a digest sent before the interval has passed.
+	if err := d.sendIfDue(a); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-server.messages:
+		t.Error("Items were sent twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDigestSendFails(t *testing.T) {
+	st := openTestStore(t)
+
+	// Nothing listens on the address once the listener is closed.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	now := time.Now()
+	a := addTestAccount(t, st, "alice",
+		feedItem{GUID: "story", Feed: "f", Title: "Story", Link: "https://example.com/story", Published: now, Score: 0.9},
+	)
+
+	d := &digest{
+		store:    st,
+		templ:    template.Must(template.ParseFiles("template.html")),
+		baseURL:  "https://feed.example",
+		interval: 24 * time.Hour,
+		size:     10,
+		smtpAddr: addr,
+		from:     "feed@feed.example",
+	}
+
+	since := now.Add(-time.Hour)
+	if err := d.send(a, since); err == nil {
+		t.Fatal("Sending to a closed port succeeded")
+	}
+
+	// The failed digest is forgotten, so that it is tried again.
+	if _, ok, err := st.lastDigest(a.ID); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("Failed digest was recorded as sent")
+	}
+	if items, err := st.digestItems(a.ID, since, 10); err != nil {
+		t.Fatal(err)
+	} else if !sameGUIDs(items, "story") {
+		t.Errorf("Got digest items %v after failing to send, want story again", guids(items))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// handlerFunc is an HTTP handler that returns its errors instead of
+// responding to them, so that every page fails the same way.
+type handlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// httpError is an error made by the client, such as a malformed form, which
+// is shown to them with its status.  Any other error a handler returns is
+// the server's, and its details are only logged.
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+func clientError(status int, format string, args ...interface{}) error {
+	return &httpError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// errorPage responds to errors with the error template, or in the API's
+// shape for requests to the API.
+type errorPage struct {
+	templ *template.Template
+}
+
+// handle adapts h to net/http, responding to the error it returns or the
+// panic it raises.
+func (p *errorPage) handle(h handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tw := &trackingWriter{ResponseWriter: w}
+
+		defer func() {
+			if v := recover(); v != nil {
+				log.Printf("Request %s: panic: %v\n%s", requestID(r), v, debug.Stack())
+				p.serve(tw, r, fmt.Errorf("panic: %v", v))
+			}
+		}()
+
+		if err := h(tw, r); err != nil {
+			p.serve(tw, r, err)
+		}
+	}
+}
+
+// serve logs err with the request's ID and responds to it, unless the
+// handler has already started its response, in which case it can only be
+// logged.
+func (p *errorPage) serve(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	message := http.StatusText(status)
+
+	if e, ok := err.(*httpError); ok {
+		status, message = e.status, e.message
+		log.Printf("Request %s: %s %s: %d %s", requestID(r), r.Method, r.URL.Path, status, message)
+	} else {
+		log.Printf("Request %s: %s %s: %s", requestID(r), r.Method, r.URL.Path, err)
+	}
+
+	if tw, ok := w.(*trackingWriter); ok && tw.wrote {
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeError(w, status, "%s", message)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := p.templ.ExecuteTemplate(&buf, "error", struct {
+		Status    int
+		Title     string
+		Message   string
+		RequestID string
+	}{
+		Status:    status,
+		Title:     http.StatusText(status),
+		Message:   message,
+		RequestID: requestID(r),
+	}); err != nil {
+		log.Printf("Request %s: rendering error page: %s", requestID(r), err)
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// trackingWriter notes whether a response has been started, after which an
+// error can no longer change it.
+type trackingWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *trackingWriter) WriteHeader(status int) {
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *trackingWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// render executes the template name into a buffer before writing it, so
+// that a template that fails shows the error page rather than half a page.
+func render(w http.ResponseWriter, templ *template.Template, name string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := templ.ExecuteTemplate(&buf, name, data); err != nil {
+		return fmt.Errorf("Rendering %s: %s", name, err)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+const requestIDKey contextKey = 1
+
+// withRequestID gives every request a random ID like a page's, sent back in
+// the X-Request-Id header, to find its errors in the log by.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := newPageID()
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
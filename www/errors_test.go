@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorPage(t *testing.T) {
+	pages := &errorPage{templ: template.Must(template.ParseFiles("template.html"))}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/form", pages.handle(func(w http.ResponseWriter, r *http.Request) error {
+		return clientError(http.StatusBadRequest, "Invalid form: no title")
+	}))
+	mux.HandleFunc("/database", pages.handle(func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New("connection to secret.internal refused")
+	}))
+	mux.HandleFunc("/panic", pages.handle(func(w http.ResponseWriter, r *http.Request) error {
+		var m map[string]int
+		m["boom"]++
+		return nil
+	}))
+	mux.HandleFunc("/api/v1/items", pages.handle(func(w http.ResponseWriter, r *http.Request) error {
+		return clientError(http.StatusNotFound, "No such item")
+	}))
+	mux.HandleFunc("/partial", pages.handle(func(w http.ResponseWriter, r *http.Request) error {
+		w.Write([]byte("half a page"))
+		return errors.New("failed halfway")
+	}))
+	h := withRequestID(mux)
+
+	for _, test := range []struct {
+		path   string
+		status int
+		want   string
+		hidden string
+	}{
+		// Client errors are shown as they are.
+		{"/form", http.StatusBadRequest, "Invalid form: no title", ""},
+		// The server's errors and panics are only logged.
+		{"/database", http.StatusInternalServerError, "Internal Server Error", "secret.internal"},
+		{"/panic", http.StatusInternalServerError, "Internal Server Error", "nil map"},
+		// The API's errors are JSON.
+		{"/api/v1/items", http.StatusNotFound, `"message":"No such item"`, "<html"},
+		// A response that has started is left as it is.
+		{"/partial", http.StatusOK, "half a page", "Internal Server Error"},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+		body := w.Body.String()
+		if w.Code != test.status {
+			t.Errorf("Got status %d for %s, want %d", w.Code, test.path, test.status)
+		}
+		if !strings.Contains(body, test.want) {
+			t.Errorf("Got body %q for %s, want it to contain %q", body, test.path, test.want)
+		}
+		if test.hidden != "" && strings.Contains(body, test.hidden) {
+			t.Errorf("Got body %q for %s, which shows %q", body, test.path, test.hidden)
+		}
+
+		// The error page gives the ID to find the error in the log by.
+		if id := w.Header().Get("X-Request-Id"); id == "" {
+			t.Errorf("Got no X-Request-Id for %s", test.path)
+		} else if test.status == http.StatusInternalServerError && !strings.Contains(body, id) {
+			t.Errorf("Error page for %s does not show request ID %s", test.path, id)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often an idle event stream is sent a comment, so proxies and clients
+// do not give up on it.
+const eventsKeepAlive = 30 * time.Second
+
+// Events are dropped for a subscriber that has this many waiting, rather
+// than holding up refresh.
+const eventsBuffer = 64
+
+type subscriber struct {
+	account   int64
+	items     chan feedItem
+	threshold float64
+}
+
+// broker fans items out to the /events streams as refresh inserts them.
+// Each stream only receives items offered to its account and scoring at least
+// its threshold, which defaults to the broker's.
+type broker struct {
+	threshold float64
+
+	mutex       sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+func newBroker(threshold float64) *broker {
+	return &broker{
+		threshold:   threshold,
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// publish sends item, scored for the account, to every stream of the
+// account whose threshold it meets.  It never blocks, and does nothing on a
+// nil broker.
+func (b *broker) publish(accountID int64, item feedItem) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for s := range b.subscribers {
+		if s.account != accountID || item.Score < s.threshold {
+			continue
+		}
+
+		select {
+		case s.items <- item:
+		default:
+			log.Printf("Dropping event for %q: subscriber is behind", item.GUID)
+		}
+	}
+}
+
+func (b *broker) subscribe(accountID int64, threshold float64) *subscriber {
+	s := &subscriber{
+		account:   accountID,
+		items:     make(chan feedItem, eventsBuffer),
+		threshold: threshold,
+	}
+
+	b.mutex.Lock()
+	b.subscribers[s] = struct{}{}
+	b.mutex.Unlock()
+
+	return s
+}
+
+func (b *broker) unsubscribe(s *subscriber) {
+	b.mutex.Lock()
+	delete(b.subscribers, s)
+	b.mutex.Unlock()
+}
+
+// isNewStory reports whether item is the first copy of its story, so that
+// the same story arriving from several feeds is only announced once.
+func (s *sqlStore) isNewStory(item feedItem) (bool, error) {
+	if item.Canonical == "" {
+		return true, nil
+	}
+
+	var exists bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM item WHERE canonical = $1 AND guid <> $2)
+	`, item.Canonical, item.GUID).Scan(&exists)
+	return !exists, err
+}
+
+// serveEvents streams the account's new items as Server-Sent Events, each an
+// "item" event with the item in the same JSON shape as the API.  ?threshold=
+// overrides the minimum score.
+func (b *broker) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	threshold := b.threshold
+	if s := r.URL.Query().Get("threshold"); s != "" {
+		var err error
+		threshold, err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			http.Error(w, "Invalid threshold", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s := b.subscribe(accountFrom(r).ID, threshold)
+	defer b.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Clients reconnect after this many milliseconds if the stream drops.
+	fmt.Fprintf(w, "retry: 10000\n\n")
+	flusher.Flush()
+
+	t := time.NewTicker(eventsKeepAlive)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-t.C:
+			if _, err := fmt.Fprintf(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case item := <-s.items:
+			data, err := json.Marshal(toAPIItem(item, sql.NullString{}, sql.NullBool{}))
+			if err != nil {
+				log.Printf("Encoding event for %q: %s", item.GUID, err)
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "event: item\nid: %s\ndata: %s\n\n", item.ID(), data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent reads lines from the stream up to the blank line ending an
+// event, and returns them.
+func readEvent(t *testing.T, stream *bufio.Reader) []string {
+	t.Helper()
+
+	var lines []string
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading event: %s", err)
+		}
+		if line = strings.TrimSuffix(line, "\n"); line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+// subscriberCount returns how many streams the broker has.
+func (b *broker) subscriberCount() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.subscribers)
+}
+
+func TestServeEvents(t *testing.T) {
+	st := openTestStore(t)
+	alice := addTestAccount(t, st, "alice")
+	bob := addTestAccount(t, st, "bob")
+
+	b := newBroker(0.5)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", b.serveEvents)
+	pages := &errorPage{templ: template.Must(template.ParseFiles("template.html"))}
+	server := httptest.NewServer(requireAccount(st, pages, mux))
+	defer server.Close()
+
+	if resp, err := http.Get(server.URL + "/events?token=nope"); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Got status %d for an unknown token, want 401", resp.StatusCode)
+	}
+
+	resp, err := http.Get(server.URL + "/events?threshold=0.7&token=" + alice.FeedToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Got status %d, want 200", resp.StatusCode)
+	} else if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Got Content-Type %q, want text/event-stream", contentType)
+	}
+
+	// The stream is subscribed by the time it starts.
+	stream := bufio.NewReader(resp.Body)
+	if lines := readEvent(t, stream); len(lines) != 1 || !strings.HasPrefix(lines[0], "retry: ") {
+		t.Errorf("Got %q to start the stream, want a retry", lines)
+	}
+
+	now := time.Now()
+	b.publish(bob.ID, feedItem{GUID: "bobs", Title: "Bob's", Published: now, Score: 0.9})
+	b.publish(alice.ID, feedItem{GUID: "low", Title: "Low", Published: now, Score: 0.6})
+	b.publish(alice.ID, feedItem{GUID: "high", Title: "High", Published: now, Score: 0.8})
+
+	// Only alice's item over her threshold is sent.
+	high := feedItem{GUID: "high"}
+	lines := readEvent(t, stream)
+	if len(lines) != 3 || lines[0] != "event: item" || lines[1] != "id: "+high.ID() || !strings.Contains(lines[2], `"guid":"high"`) {
+		t.Errorf("Got event %q, want the item high", lines)
+	}
+
+	// Closing the stream unsubscribes it.
+	resp.Body.Close()
+	for deadline := time.Now().Add(5 * time.Second); b.subscriberCount() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Closed stream is still subscribed")
+		}
+	}
+}
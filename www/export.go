@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+)
+
+// judgementRecord is an account's judgement of an item, as exported for
+// backing up, moving to another server or training models elsewhere.
+type judgementRecord struct {
+	Account   string     `json:"account"`
+	GUID      string     `json:"guid"`
+	Feed      string     `json:"feed"`
+	Title     string     `json:"title"`
+	Link      string     `json:"link"`
+	Canonical string     `json:"canonical,omitempty"`
+	Published time.Time  `json:"published"`
+	Action    action     `json:"action,omitempty"`
+	Judgement *bool      `json:"judgement"`
+	Explored  bool       `json:"explored,omitempty"`
+	Judged    *time.Time `json:"judged,omitempty"`
+}
+
+// Judgements are exported and imported as JSON, one record per line, or as
+// CSV with a header of csvColumns.
+const (
+	formatJSONL = "jsonl"
+	formatCSV   = "csv"
+)
+
+var csvColumns = []string{"account", "guid", "feed", "title", "link", "canonical", "published", "action", "judgement", "explored", "judged"}
+
+// exportJudgements writes every judgement to w in format.
+func exportJudgements(st Store, w io.Writer, format string) error {
+	records, err := st.judgementRecords()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case formatJSONL:
+		return writeJSONL(w, records)
+	case formatCSV:
+		return writeCSV(w, records)
+	default:
+		return fmt.Errorf("Unknown format %q", format)
+	}
+}
+
+// importJudgements reads judgements in format from r and merges them into
+// the store.  Items are matched by GUID and added if the store does not have
+// them.  A judgement is kept if the account had not judged the item, or had
+// judged it before the imported judgement was made; judgements of accounts
+// the store does not have are skipped.
+func importJudgements(st Store, r io.Reader, format string) error {
+	var records []judgementRecord
+	var err error
+	switch format {
+	case formatJSONL:
+		records, err = readJSONL(r)
+	case formatCSV:
+		records, err = readCSV(r)
+	default:
+		err = fmt.Errorf("Unknown format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	accounts, err := st.accounts()
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[string]int64)
+	for _, a := range accounts {
+		ids[a.Name] = a.ID
+	}
+
+	var items, judgements, skipped int
+	for _, rec := range records {
+		id, ok := ids[rec.Account]
+		if !ok {
+			log.Printf("Skipping judgement of %q by unknown account %q", rec.GUID, rec.Account)
+			skipped++
+			continue
+		}
+
+		added, judged, err := st.importJudgement(id, rec)
+		if err != nil {
+			return fmt.Errorf("Importing judgement of %q by %q: %s", rec.GUID, rec.Account, err)
+		}
+		if added {
+			items++
+		}
+		if judged {
+			judgements++
+		} else {
+			skipped++
+		}
+	}
+
+	log.Printf("Imported %d new items and %d judgements, skipped %d judgements", items, judgements, skipped)
+
+	// Imported items may be copies of stories already here.
+	return st.groupDuplicates()
+}
+
+func writeJSONL(w io.Writer, records []judgementRecord) error {
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readJSONL(r io.Reader) ([]judgementRecord, error) {
+	var records []judgementRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec judgementRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("Line %d: %s", line, err)
+		}
+		if err := rec.check(); err != nil {
+			return nil, fmt.Errorf("Line %d: %s", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// Times in CSV are written like the JSON ones.
+const csvTime = time.RFC3339Nano
+
+func writeCSV(w io.Writer, records []judgementRecord) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvColumns); err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		var judgement, judged string
+		if r.Judgement != nil {
+			judgement = strconv.FormatBool(*r.Judgement)
+		}
+		if r.Judged != nil {
+			judged = r.Judged.Format(csvTime)
+		}
+
+		if err := cw.Write([]string{
+			r.Account, r.GUID, r.Feed, r.Title, r.Link, r.Canonical,
+			r.Published.Format(csvTime), string(r.Action), judgement,
+			strconv.FormatBool(r.Explored), judged,
+		}); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// readCSV reads records from CSV with a header naming its columns, which may
+// come in any order.  Only account and guid are required.
+func readCSV(r io.Reader) ([]judgementRecord, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Reading header: %s", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"account", "guid"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("No %s column", name)
+		}
+	}
+
+	var records []judgementRecord
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		line, _ := cr.FieldPos(0)
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return row[i]
+			}
+			return ""
+		}
+
+		rec := judgementRecord{
+			Account:   field("account"),
+			GUID:      field("guid"),
+			Feed:      field("feed"),
+			Title:     field("title"),
+			Link:      field("link"),
+			Canonical: field("canonical"),
+			Action:    action(field("action")),
+		}
+
+		if s := field("published"); s != "" {
+			if rec.Published, err = time.Parse(csvTime, s); err != nil {
+				return nil, fmt.Errorf("Line %d: published: %s", line, err)
+			}
+		}
+
+		if s := field("judgement"); s != "" {
+			judgement, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: judgement: %s", line, err)
+			}
+			rec.Judgement = &judgement
+		}
+
+		if s := field("explored"); s != "" {
+			if rec.Explored, err = strconv.ParseBool(s); err != nil {
+				return nil, fmt.Errorf("Line %d: explored: %s", line, err)
+			}
+		}
+
+		if s := field("judged"); s != "" {
+			judged, err := time.Parse(csvTime, s)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: judged: %s", line, err)
+			}
+			rec.Judged = &judged
+		}
+
+		if err := rec.check(); err != nil {
+			return nil, fmt.Errorf("Line %d: %s", line, err)
+		}
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
+
+// check returns an error if the record cannot be imported.
+func (r judgementRecord) check() error {
+	if r.Account == "" || r.GUID == "" {
+		return fmt.Errorf("Judgements need an account and a guid")
+	}
+
+	if _, ok := parseAction(string(r.Action)); r.Action != "" && !ok {
+		return fmt.Errorf("Unknown action %q", r.Action)
+	}
+
+	return nil
+}
+
+// judgementRecords returns every item an account has judged or taken an
+// action on, by account and then by when it was published.  Judged is when
+// the latest judgement event that has not been undone was made; items
+// judged before there were events have none.
+func (s *sqlStore) judgementRecords() ([]judgementRecord, error) {
+	rows, err := s.db.Query(`
+		SELECT account.name, item.guid, item.feed, item.title, item.link, item.canonical, item.published,
+			COALESCE(user_item.action, ''), user_item.judgement, user_item.explored, judgement_event.created
+		FROM user_item
+		JOIN account ON account.id = user_item.account
+		JOIN item ON item.guid = user_item.guid
+		LEFT JOIN judgement_event ON judgement_event.id = (
+			SELECT max(latest.id)
+			FROM judgement_event AS latest
+			WHERE latest.account = user_item.account AND latest.guid = user_item.guid AND NOT latest.undone
+		)
+		WHERE user_item.action IS NOT NULL OR user_item.judgement IS NOT NULL
+		ORDER BY account.name, item.published, item.guid
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []judgementRecord
+	for rows.Next() {
+		var r judgementRecord
+		var judgement sql.NullBool
+		var judged sql.NullTime
+		if err := rows.Scan(&r.Account, &r.GUID, &r.Feed, &r.Title, &r.Link, &r.Canonical, &r.Published, &r.Action, &judgement, &r.Explored, &judged); err != nil {
+			return nil, err
+		}
+
+		if judgement.Valid {
+			r.Judgement = &judgement.Bool
+		}
+		if judged.Valid {
+			r.Judged = &judged.Time
+		}
+
+		records = append(records, r)
+	}
+
+	return records, rows.Err()
+}
+
+// importJudgement adds the record's item if there is no item with its GUID,
+// and gives the account the record's judgement unless the account has one
+// that is as recent.  It reports whether the item was added and whether the
+// judgement was kept.
+func (s *sqlStore) importJudgement(accountID int64, r judgementRecord) (bool, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO item (guid, feed, title, link, canonical, published)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (guid) DO NOTHING
+	`, r.GUID, r.Feed, r.Title, r.Link, r.Canonical, r.Published.UTC())
+	if err != nil {
+		return false, false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, false, err
+	}
+	added := n > 0
+
+	var judged bool
+	err = tx.QueryRow(`
+		SELECT action IS NOT NULL OR judgement IS NOT NULL
+		FROM user_item
+		WHERE account = $1 AND guid = $2
+	`, accountID, r.GUID).Scan(&judged)
+	if err != nil && err != sql.ErrNoRows {
+		return added, false, err
+	}
+
+	if judged {
+		// Judgements made before there were events can be replaced by any
+		// that has a time.
+		var last time.Time
+		err := tx.QueryRow(`
+			SELECT created
+			FROM judgement_event
+			WHERE id = (
+				SELECT max(id)
+				FROM judgement_event
+				WHERE account = $1 AND guid = $2 AND NOT undone
+			)
+		`, accountID, r.GUID).Scan(&last)
+		if err != nil && err != sql.ErrNoRows {
+			return added, false, err
+		}
+
+		if r.Judged == nil || (err == nil && !last.Before(*r.Judged)) {
+			return added, false, tx.Commit()
+		}
+	}
+
+	if r.Action != "" {
+		created := time.Now()
+		if r.Judged != nil {
+			created = *r.Judged
+		}
+
+		if _, err := tx.Exec(`
+			INSERT INTO judgement_event (account, guid, action, created, page, explored)
+			VALUES ($1, $2, $3, $4, '', $5)
+		`, accountID, r.GUID, r.Action, created.UTC(), r.Explored); err != nil {
+			return added, false, err
+		}
+	}
+
+	var judgement sql.NullBool
+	if r.Judgement != nil {
+		judgement = sql.NullBool{Bool: *r.Judgement, Valid: true}
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO user_item (account, guid, action, judgement, explored)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (account, guid) DO UPDATE
+		SET action = excluded.action, judgement = excluded.judgement, explored = excluded.explored
+	`, accountID, r.GUID, sql.NullString{String: string(r.Action), Valid: r.Action != ""}, judgement, r.Explored); err != nil {
+		return added, false, err
+	}
+
+	return added, true, tx.Commit()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCSV(t *testing.T) {
+	records, err := readCSV(strings.NewReader(`guid,judged,account,title,judgement,action,explored,published
+a,2024-05-01T10:00:00Z,alice,"Quoted, ""title""",true,love,true,2024-04-30T08:00:00Z
+b,,bob,,,,,
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Got %d records, want 2", len(records))
+	}
+
+	a := records[0]
+	if a.Account != "alice" || a.GUID != "a" || a.Title != `Quoted, "title"` || a.Action != actionLove || !a.Explored {
+		t.Errorf("Got first record %+v", a)
+	}
+	if a.Judgement == nil || !*a.Judgement {
+		t.Errorf("Got first judgement %v, want true", a.Judgement)
+	}
+	if want := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC); a.Judged == nil || !a.Judged.Equal(want) {
+		t.Errorf("Got first judged %v, want %v", a.Judged, want)
+	}
+	if want := time.Date(2024, 4, 30, 8, 0, 0, 0, time.UTC); !a.Published.Equal(want) {
+		t.Errorf("Got first published %v, want %v", a.Published, want)
+	}
+
+	b := records[1]
+	if b.Account != "bob" || b.GUID != "b" || b.Judgement != nil || b.Judged != nil || b.Action != "" {
+		t.Errorf("Got second record %+v", b)
+	}
+
+	for _, test := range []struct {
+		name, csv string
+	}{
+		{"no account column", "guid\na\n"},
+		{"no guid", "account,guid\nalice,\n"},
+		{"unknown action", "account,guid,action\nalice,a,shrug\n"},
+		{"bad judgement", "account,guid,judgement\nalice,a,maybe\n"},
+		{"bad time", "account,guid,judged\nalice,a,yesterday\n"},
+		{"ragged row", "account,guid\nalice,a,extra\n"},
+	} {
+		if _, err := readCSV(strings.NewReader(test.csv)); err == nil {
+			t.Errorf("Read CSV with %s", test.name)
+		}
+	}
+}
+
+func TestImportJudgements(t *testing.T) {
+	for _, format := range []string{formatJSONL, formatCSV} {
+		t.Run(format, func(t *testing.T) {
+			now := time.Now()
+
+			src := openTestStore(t)
+			a := addTestAccount(t, src, "alice",
+				feedItem{GUID: "shared", Feed: "f", Title: "Shared", Link: "https://example.com/shared", Published: now},
+				feedItem{GUID: "new", Feed: "f", Title: `A "new", item`, Link: "https://example.com/new", Canonical: "https://example.com/new", Published: now},
+				feedItem{GUID: "later", Feed: "f", Title: "Later", Link: "https://example.com/later", Published: now},
+			)
+			for guid, act := range map[string]action{"shared": actionLove, "new": actionSeen, "later": actionNotInterested} {
+				if err := src.judge(a.ID, guid, act, false, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var exported bytes.Buffer
+			if err := exportJudgements(src, &exported, format); err != nil {
+				t.Fatal(err)
+			}
+
+			// The destination has its own copy of shared, an account for
+			// alice who made a judgement after the exported ones, and no
+			// account for bob.
+			dst := openTestStore(t)
+			b := addTestAccount(t, dst, "alice",
+				feedItem{GUID: "shared", Feed: "g", Title: "Shared elsewhere", Link: "https://example.com/shared", Published: now},
+				feedItem{GUID: "later", Feed: "f", Title: "Later", Link: "https://example.com/later", Published: now},
+			)
+			if err := dst.judge(b.ID, "later", actionLater, false, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			data := exported.String()
+			if format == formatJSONL {
+				data += `{"account":"bob","guid":"shared","judgement":true}` + "\n"
+			} else {
+				data += "bob,shared,,,,,,,true,,\n"
+			}
+
+			for i := 0; i < 2; i++ {
+				if err := importJudgements(dst, strings.NewReader(data), format); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			records, err := dst.judgementRecords()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]judgementRecord)
+			for _, r := range records {
+				got[r.Account+"/"+r.GUID] = r
+			}
+			if len(got) != 3 {
+				t.Errorf("Got %d judgements, want 3: %+v", len(got), records)
+			}
+
+			// Items are matched by guid, keeping the destination's copy.
+			if r := got["alice/shared"]; r.Action != actionLove || r.Feed != "g" {
+				t.Errorf("Got %+v for shared, want loved in g", r)
+			}
+			// Items the destination lacks are added.
+			if r := got["alice/new"]; r.Action != actionSeen || r.Title != `A "new", item` || r.Canonical != "https://example.com/new" {
+				t.Errorf("Got %+v for new, want seen with its title and canonical link", r)
+			}
+			// Newer judgements are kept.
+			if r := got["alice/later"]; r.Action != actionLater {
+				t.Errorf("Got %+v for later, want the newer later", r)
+			}
+		})
+	}
+}
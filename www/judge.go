@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+// action is what the user did with an item.  Unlike the boolean judgement
+// the classifier is trained on, it also records neutral outcomes.
+type action string
+
+const (
+	// Implicit: the user opened the item.
+	actionClick action = "click"
+	// Implicit: the user moved on to the next page without opening the item.
+	actionSkip action = "skip"
+
+	actionNotInterested action = "not_interested"
+	actionSeen          action = "seen"
+	actionLater         action = "later"
+	actionLove          action = "love"
+)
+
+type actionButton struct {
+	Action action
+	Label  string
+}
+
+// explicitActions are the actions offered as buttons next to each item.
+var explicitActions = []actionButton{
+	{actionNotInterested, "not interested"},
+	{actionSeen, "seen"},
+	{actionLater, "later"},
+	{actionLove, "love"},
+}
+
+// parseAction returns the action named s, and false if there is none.
+func parseAction(s string) (action, bool) {
+	switch a := action(s); a {
+	case actionClick, actionSkip, actionNotInterested, actionSeen, actionLater, actionLove:
+		return a, true
+	default:
+		return "", false
+	}
+}
+
+// judgement is the label the classifier learns from the action, which is
+// NULL for actions that say nothing about whether the user liked the item.
+func (a action) judgement() sql.NullBool {
+	switch a {
+	case actionClick, actionLove:
+		return sql.NullBool{Bool: true, Valid: true}
+	case actionSkip, actionNotInterested:
+		return sql.NullBool{Bool: false, Valid: true}
+	default:
+		return sql.NullBool{}
+	}
+}
+
+// Items which the account whose user_item rows are joined in has not
+// judged yet.  Items judged before actions were recorded have a judgement but
+// no action.
+const pendingCondition = `user_item.action IS NULL AND user_item.judgement IS NULL`
+
+// Items whose action, if any, the user took implicitly, which another
+// implicit action may replace.
+const implicitCondition = `(` + pendingCondition + ` OR user_item.action IN ('click', 'skip'))`
+
+// implicit reports whether a is inferred from what the user did rather than
+// chosen.  An implicit action never replaces an explicit one: opening an
+// item saved for later does not unsave it.
+func (a action) implicit() bool {
+	return a == actionClick || a == actionSkip
+}
+
+// flipped is the action that reverses the judgement a implies, for
+// correcting a mistaken judgement from the history page.  It returns false
+// for actions that do not imply a judgement.  Both directions are explicit
+// actions, since an implicit one would not replace the explicit
+// not_interested it is meant to correct.
+func (a action) flipped() (action, bool) {
+	judgement := a.judgement()
+	if !judgement.Valid {
+		return "", false
+	} else if judgement.Bool {
+		return actionNotInterested, true
+	} else {
+		return actionLove, true
+	}
+}
+
+// newPageID returns a random identifier for a rendered page, recorded with
+// every judgement made from it so that the page can be undone as a whole.
+func newPageID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// judge records the action the account took on guid, and on every other
+// copy of the same story, as grouped by groupDuplicates, in the
+// judgement_event log and in the account's user_item rows.  If onlyPending is
+// set, copies which already have a judgement or action keep it, and if a is
+// implicit, copies with an explicit one keep it.  page is the
+// ID of the page the action was taken on, or "" if it was not taken on an
+// index page.  It returns sql.ErrNoRows if there is no item guid.
+func (s *sqlStore) judge(accountID int64, guid string, a action, onlyPending bool, page string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var story string
+	if err := tx.QueryRow(`
+		SELECT COALESCE(duplicate_of, guid)
+		FROM item
+		WHERE guid = $1
+	`, guid).Scan(&story); err != nil {
+		return err
+	}
+
+	query := `
+		SELECT item.guid
+		FROM item
+		LEFT JOIN user_item ON user_item.guid = item.guid AND user_item.account = $2
+		WHERE COALESCE(item.duplicate_of, item.guid) = $1
+	`
+	if onlyPending {
+		query += ` AND ` + pendingCondition
+	} else if a.implicit() {
+		query += ` AND ` + implicitCondition
+	}
+
+	rows, err := tx.Query(query, story, accountID)
+	if err != nil {
+		return err
+	}
+
+	var guids []string
+	for rows.Next() {
+		var guid string
+		if err := rows.Scan(&guid); err != nil {
+			rows.Close()
+			return err
+		}
+		guids = append(guids, guid)
+	}
+
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Whether the item was shown in an exploration slot, rather than for
+	// its score, matters to the trainer.
+	var explored bool
+	if page != "" {
+		err := tx.QueryRow(`
+			SELECT explored
+			FROM impression
+			WHERE page = $1 AND guid = $2 AND account = $3
+		`, page, guid, accountID).Scan(&explored)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, guid := range guids {
+		if _, err := tx.Exec(`
+			INSERT INTO judgement_event (account, guid, action, created, page, explored)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, accountID, guid, a, now, page, explored); err != nil {
+			return err
+		}
+
+		// Copies from feeds the account is not subscribed to have no row yet.
+		if _, err := tx.Exec(`
+			INSERT INTO user_item (account, guid, action, judgement, explored)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (account, guid) DO UPDATE
+			SET action = excluded.action, judgement = excluded.judgement, explored = excluded.explored
+		`, accountID, guid, a, a.judgement(), explored); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// applyEvents sets the account's action, judgement and explored flag of
+// guid from the latest of its judgement events that has not been undone, or
+// clears them if there is none.
+func applyEvents(tx *sql.Tx, accountID int64, guid string) error {
+	var a action
+	var explored bool
+	err := tx.QueryRow(`
+		SELECT action, explored
+		FROM judgement_event
+		WHERE account = $1 AND guid = $2 AND NOT undone
+		ORDER BY id DESC
+		LIMIT 1
+	`, accountID, guid).Scan(&a, &explored)
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec(`
+			UPDATE user_item
+			SET action = NULL, judgement = NULL, explored = FALSE
+			WHERE account = $1 AND guid = $2
+		`, accountID, guid)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE user_item
+		SET action = $1, judgement = $2, explored = $3
+		WHERE account = $4 AND guid = $5
+	`, a, a.judgement(), explored, accountID, guid)
+	return err
+}
+
+// undoLastPage undoes every judgement the account made from its most recent
+// index page that has judgements which have not been undone yet.  It returns
+// how many judgements were undone.
+func (s *sqlStore) undoLastPage(accountID int64) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var page string
+	err = tx.QueryRow(`
+		SELECT page
+		FROM judgement_event
+		WHERE account = $1 AND page <> '' AND NOT undone
+		ORDER BY id DESC
+		LIMIT 1
+	`, accountID).Scan(&page)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(`
+		SELECT DISTINCT guid
+		FROM judgement_event
+		WHERE account = $1 AND page = $2 AND NOT undone
+	`, accountID, page)
+	if err != nil {
+		return 0, err
+	}
+
+	var guids []string
+	for rows.Next() {
+		var guid string
+		if err := rows.Scan(&guid); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		guids = append(guids, guid)
+	}
+
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE judgement_event
+		SET undone = TRUE
+		WHERE account = $1 AND page = $2
+	`, accountID, page); err != nil {
+		return 0, err
+	}
+
+	for _, guid := range guids {
+		if err := applyEvents(tx, accountID, guid); err != nil {
+			return 0, err
+		}
+	}
+
+	log.Printf("Undid judgements of %d items from page %s", len(guids), page)
+
+	return len(guids), tx.Commit()
+}
+
+type judgementEvent struct {
+	ID      int64
+	Item    feedItem
+	Action  action
+	Created time.Time
+	Page    string
+}
+
+// Flip is the action offered to reverse the event's judgement, or "" if it
+// has none.
+func (e judgementEvent) Flip() action {
+	flipped, _ := e.Action.flipped()
+	return flipped
+}
+
+// recentJudgements returns the account's latest judgement events which have
+// not been undone, newest first.
+func (s *sqlStore) recentJudgements(accountID int64, limit int) ([]judgementEvent, error) {
+	rows, err := s.db.Query(`
+		SELECT judgement_event.id, judgement_event.action, judgement_event.created, judgement_event.page,
+			item.guid, item.feed, item.title, item.link
+		FROM judgement_event
+		JOIN item ON item.guid = judgement_event.guid
+		WHERE judgement_event.account = $1 AND NOT judgement_event.undone AND item.duplicate_of IS NULL
+		ORDER BY judgement_event.id DESC
+		LIMIT $2
+	`, accountID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]judgementEvent, 0)
+	for rows.Next() {
+		var e judgementEvent
+		if err := rows.Scan(&e.ID, &e.Action, &e.Created, &e.Page, &e.Item.GUID, &e.Item.Feed, &e.Item.Title, &e.Item.Link); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// itemFeeds returns the names of every feed the duplicate group headed by
+// guid was seen in.
+func (s *sqlStore) itemFeeds(guid string) ([]string, error) {
+	rows, err := s.db.Query(`
+		SELECT DISTINCT feed
+		FROM item
+		WHERE guid = $1 OR duplicate_of = $1
+		ORDER BY feed
+	`, guid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feeds []string
+	for rows.Next() {
+		var feed string
+		if err := rows.Scan(&feed); err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, rows.Err()
+}
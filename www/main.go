@@ -1,66 +1,101 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
 	"database/sql"
-	_ "github.com/lib/pq"
+	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
-func updateScores(classifier *classifier, db *sql.DB) error {
+// updateScores rescores every unjudged item, stopping early with ctx's error
+// once ctx is done.
+func updateScores(ctx context.Context, classifier *classifier, st Store) error {
 	log.Printf("Updating scores...")
 	defer log.Printf("Done updating scores")
 
-	rows, err := db.Query(`
-		SELECT guid, title, feed
-		FROM item
-		WHERE judgement IS NULL
-	`)
+	items, err := st.unjudgedItems()
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var item feedItem
-		if err := rows.Scan(&item.GUID, &item.Title, &item.Feed); err != nil {
+
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		score := classifier.classify(classifiableString(item))
 
-		if _, err := db.Exec(`
-			UPDATE item
-			SET score = $1
-			WHERE guid = $2
-		`, score, item.GUID); err != nil {
+		score := classifier.classify(classifiableString(item.Account, item.feedItem))
+
+		if err := st.setScore(item.Account, item.GUID, score); err != nil {
 			log.Printf("Updating score for item %q: %s", item.GUID, err)
 		}
 	}
-	return rows.Err()
+
+	return nil
 }
 
-func main() {
+// serveCommand is "www serve", and what www does without a command: it
+// serves the site and refreshes the feeds in the background.
+func serveCommand(args []string) {
+	cfg, err := loadConfig(commandFlags("serve", ""), args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	log.Printf("Connecting to database...")
-	db, err := sql.Open("postgres", "postgresql://feed@10.0.1.1:26257/feed?sslmode=disable")
+	store, err := openStore(cfg.Database)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	defer db.Close()
 	log.Printf("Connected")
 
+	if _, err := store.migrate(); err != nil {
+		log.Fatalf("Migrating database: %s", err)
+	}
+
 	var classifierMutex sync.RWMutex
-	classifier := newClassifier()
+	classifier := newClassifier(cfg.Model.FastText, cfg.Model.Path)
+
+	// ctx is done once the server is told to stop, and the goroutines in
+	// background are waited for before the classifier and store are closed.
+	signals, stopSignals := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stopSignals()
+	ctx, cancel := context.WithCancel(signals)
+	defer cancel()
+
+	var background sync.WaitGroup
 
 	//trainingDebouncer := newDebouncer(time.Hour)
 	//defer trainingDebouncer.stop()
 
+	//background.Add(1)
 	//go func() {
-	//	for range trainingDebouncer.C {
+	//	defer background.Done()
+	//	for {
+	//		select {
+	//		case <-ctx.Done():
+	//			return
+	//		case <-trainingDebouncer.C:
+	//		}
+
 	//		log.Printf("Training...")
-	//		if err := train(); err != nil {
+	//		candidate, err := train(cfg.Trainer, cfg.Model.Path)
+	//		if err != nil {
+	//			panic(err)
+	//		}
+	//		if err := promoteModel(cfg.Model.Path, candidate); err != nil {
 	//			panic(err)
 	//		}
 	//		log.Printf("Done training")
@@ -69,133 +104,862 @@ func main() {
 	//		if err := classifier.stop(); err != nil {
 	//			log.Printf("Stopping classifier: %s", err)
 	//		}
-	//		classifier = newClassifier()
+	//		classifier = newClassifier(cfg.Model.FastText, cfg.Model.Path)
 	//		classifierMutex.Unlock()
 
 	//		classifierMutex.RLock()
-	//		if err := updateScores(classifier, db); err != nil {
+	//		if err := updateScores(ctx, classifier, store); err != nil {
 	//			log.Printf("Updating scores: %s", err)
 	//		}
 	//		classifierMutex.RUnlock()
 	//	}
 	//}()
 
+	// New items scoring at least events.threshold are pushed to /events.
+	events := newBroker(cfg.Events.Threshold)
+
+	// Downloading every article is slow and not every deployment wants it,
+	// so it is only done if refresh.fetch_articles is set.
+	shouldFetchArticles := cfg.Refresh.FetchArticles
+
+	background.Add(1)
 	go func() {
-		t := time.NewTicker(3 * time.Hour)
+		defer background.Done()
+
+		t := time.NewTicker(cfg.Refresh.Interval.Duration)
 		defer t.Stop()
 
-		if err := refresh(classifier, db); err != nil {
+		if err := refresh(ctx, classifier, store, events); err != nil {
 			log.Printf("Refresh: %s", err)
 		}
 
-		if err := updateScores(classifier, db); err != nil {
+		if shouldFetchArticles {
+			if err := fetchArticles(ctx, classifier, store); err != nil {
+				log.Printf("Fetching articles: %s", err)
+			}
+		}
+
+		if err := updateScores(ctx, classifier, store); err != nil {
 			log.Printf("Updating scores: %s", err)
 		}
 
-		for range t.C {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+
 			log.Printf("Refreshing...")
 			classifierMutex.RLock()
-			if err := refresh(classifier, db); err != nil {
+			if err := refresh(ctx, classifier, store, events); err != nil {
 				log.Printf("Refresh: %s", err)
 			}
+			if shouldFetchArticles {
+				if err := fetchArticles(ctx, classifier, store); err != nil {
+					log.Printf("Fetching articles: %s", err)
+				}
+			}
 			classifierMutex.RUnlock()
 			log.Printf("Done refreshing")
 		}
 	}()
 
-	var templ = template.Must(template.ParseFiles("template.html"))
+	// Snapshots of clicked articles are only kept if archive.dir is set.
+	var arch *archive
+	if cfg.Archive.Dir != "" {
+		arch, err = newArchive(store, cfg.Archive.Dir, int64(cfg.Archive.MaxBytes))
+		if err != nil {
+			log.Fatalf("Opening archive: %s", err)
+		}
+	}
+
+	// config.validate has already checked index.feed_boosts and
+	// index.ranker.
+	feedBoosts, err := parseFeedBoosts(cfg.Index.FeedBoosts)
+	if err != nil {
+		log.Fatalf("Parsing index.feed_boosts: %s", err)
+	}
+
+	// Rankers can be compared by picking one with the ranker query
+	// parameter; index.ranker sets the one used otherwise.
+	rankers := newRankers(cfg.Index.DecayHalfLife.Duration, feedBoosts)
+	defaultRanker := cfg.Index.Ranker
 
-	http.HandleFunc("/click", func(w http.ResponseWriter, r *http.Request) {
+	templ, err := template.ParseFiles(cfg.Template)
+	if err != nil {
+		log.Fatalf("Loading template: %s", err)
+	}
+
+	// Pages return their errors to be shown on the error page.
+	pages := &errorPage{templ: templ}
+	handle := func(pattern string, h handlerFunc) {
+		http.HandleFunc(pattern, pages.handle(h))
+	}
+
+	admins := make(map[string]bool)
+	for _, name := range strings.Split(cfg.Admins, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			admins[name] = true
+		}
+	}
+
+	(&api{
+		store:         store,
+		arch:          arch,
+		classifier:    classifier,
+		modelPath:     cfg.Model.Path,
+		rankers:       rankers,
+		defaultRanker: defaultRanker,
+		admins:        admins,
+	}).register(http.DefaultServeMux)
+
+	out := &outFeed{
+		store:     store,
+		baseURL:   cfg.BaseURL,
+		threshold: cfg.Out.Threshold,
+		topPerDay: cfg.Out.TopPerDay,
+	}
+
+	// Digests go to every account with an email address.
+	if cfg.Digest.SMTPAddr != "" {
+		d := &digest{
+			store:        store,
+			templ:        templ,
+			baseURL:      strings.TrimRight(cfg.BaseURL, "/"),
+			interval:     cfg.Digest.Interval.Duration,
+			size:         cfg.Digest.Size,
+			smtpAddr:     cfg.Digest.SMTPAddr,
+			smtpUser:     cfg.Digest.SMTPUser,
+			smtpPassword: cfg.Digest.SMTPPassword,
+			from:         cfg.Digest.From,
+		}
+
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			d.run(ctx)
+		}()
+	}
+
+	http.HandleFunc("/events", events.serveEvents)
+	handle("/out/atom.xml", out.serveAtom)
+	handle("/out/rss.xml", out.serveRSS)
+
+	// Anyone can sign up if allow_signup is set; otherwise only the first
+	// account can be created this way.
+	allowSignup := cfg.AllowSignup
+
+	// Session cookies are marked Secure when served over TLS, or always if
+	// secure_cookies is set for a server behind a TLS-terminating proxy.
+	secureCookies := cfg.SecureCookies
+
+	secure := func(r *http.Request) bool {
+		return secureCookies || r.TLS != nil
+	}
+
+	canSignUp := func() (bool, error) {
+		if allowSignup {
+			return true, nil
+		}
+
+		n, err := store.countAccounts()
+		return n == 0, err
+	}
+
+	handle("/login", func(w http.ResponseWriter, r *http.Request) error {
+		signUp, err := canSignUp()
+		if err != nil {
+			return err
+		}
+
+		var loginError string
+
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err != nil {
+				return clientError(http.StatusBadRequest, "Invalid form: %s", err)
+			}
+
+			var user account
+			var err error
+			if token := r.PostForm.Get("token"); token != "" {
+				var ok bool
+				user, ok, err = apiTokenAccount(store, token)
+				if err == nil && !ok {
+					err = errBadLogin
+				}
+			} else {
+				user, err = authenticate(store, r.PostForm.Get("name"), r.PostForm.Get("password"))
+			}
+
+			if err == nil {
+				if err := startSession(store, w, user, secure(r)); err != nil {
+					return err
+				}
+
+				http.Redirect(w, r, "/", http.StatusFound)
+				return nil
+			} else if err != errBadLogin {
+				return err
+			}
+
+			log.Printf("Failed login as %q from %s", r.PostForm.Get("name"), r.RemoteAddr)
+
+			// Slows down guessing passwords.
+			time.Sleep(failedLoginDelay)
+
+			loginError = err.Error()
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+
+		return render(w, templ, "login", struct {
+			Error     string
+			CanSignUp bool
+			CSRF      string
+		}{
+			Error:     loginError,
+			CanSignUp: signUp,
+			CSRF:      csrfToken(r),
+		})
+	})
+
+	handle("/signup", func(w http.ResponseWriter, r *http.Request) error {
+		if signUp, err := canSignUp(); err != nil {
+			return err
+		} else if !signUp {
+			return clientError(http.StatusForbidden, "Signing up is closed")
+		}
+
+		var signupError string
+
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err != nil {
+				return clientError(http.StatusBadRequest, "Invalid form: %s", err)
+			}
+
+			classifierMutex.RLock()
+			user, err := createAccount(store, classifier, r.PostForm.Get("name"), r.PostForm.Get("password"), r.PostForm.Get("email"))
+			classifierMutex.RUnlock()
+			if err == nil {
+				if err := startSession(store, w, user, secure(r)); err != nil {
+					return err
+				}
+
+				http.Redirect(w, r, "/feeds", http.StatusFound)
+				return nil
+			}
+
+			signupError = err.Error()
+			w.WriteHeader(http.StatusBadRequest)
+		}
+
+		return render(w, templ, "signup", struct {
+			Error string
+			CSRF  string
+		}{
+			Error: signupError,
+			CSRF:  csrfToken(r),
+		})
+	})
+
+	handle("/logout", func(w http.ResponseWriter, r *http.Request) error {
+		if err := parsePost(r); err != nil {
+			return err
+		}
+
+		if err := endSession(store, w, r, secure(r)); err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	})
+
+	handle("/feeds", func(w http.ResponseWriter, r *http.Request) error {
+		user := accountFrom(r)
+
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err != nil {
+				return clientError(http.StatusBadRequest, "Invalid form: %s", err)
+			}
+
+			feed := r.PostForm.Get("feed")
+			exists, err := store.feedExists(feed)
+			if err != nil {
+				return err
+			} else if !exists {
+				return clientError(http.StatusBadRequest, "Unknown feed")
+			}
+
+			if r.PostForm.Get("subscribe") != "" {
+				classifierMutex.RLock()
+				err = subscribe(store, classifier, user.ID, feed)
+				classifierMutex.RUnlock()
+			} else {
+				err = store.unsubscribe(user.ID, feed)
+			}
+			if err != nil {
+				return err
+			}
+
+			http.Redirect(w, r, "/feeds", http.StatusFound)
+			return nil
+		}
+
+		feeds, err := store.listSubscriptions(user.ID)
+		if err != nil {
+			return err
+		}
+
+		return render(w, templ, "feeds", struct {
+			Feeds   []subscriptionRow
+			Account account
+			CSRF    string
+		}{
+			Feeds:   feeds,
+			Account: user,
+			CSRF:    csrfToken(r),
+		})
+	})
+
+	handle("/tokens", func(w http.ResponseWriter, r *http.Request) error {
+		user := accountFrom(r)
+
+		var created string
+
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err != nil {
+				return clientError(http.StatusBadRequest, "Invalid form: %s", err)
+			}
+
+			if s := r.PostForm.Get("revoke"); s != "" {
+				id, err := strconv.ParseInt(s, 10, 64)
+				if err != nil {
+					return clientError(http.StatusBadRequest, "Invalid token ID")
+				}
+
+				if _, err := store.revokeToken(user.ID, id); err != nil {
+					return err
+				}
+
+				http.Redirect(w, r, "/tokens", http.StatusFound)
+				return nil
+			}
+
+			_, token, err := createToken(store, user.ID, r.PostForm.Get("name"))
+			if err == errTokenName {
+				return clientError(http.StatusBadRequest, "%s", err)
+			} else if err != nil {
+				return err
+			}
+
+			// Shown once here, since only its hash is kept.
+			created = token
+		}
+
+		tokens, err := store.listTokens(user.ID)
+		if err != nil {
+			return err
+		}
+
+		return render(w, templ, "tokens", struct {
+			Tokens  []apiToken
+			Created string
+			Account account
+			CSRF    string
+		}{
+			Tokens:  tokens,
+			Created: created,
+			Account: user,
+			CSRF:    csrfToken(r),
+		})
+	})
+
+	handle("/click", func(w http.ResponseWriter, r *http.Request) error {
 		if err := r.ParseForm(); err != nil {
-			panic(err)
+			return clientError(http.StatusBadRequest, "Invalid form: %s", err)
+		}
+
+		// Only the item is taken from the link; where it redirects to comes
+		// from the database, so /click cannot be used to send people elsewhere.
+		guid, err := guidFromID(r.Form.Get("id"))
+		if err != nil {
+			return clientError(http.StatusBadRequest, "Invalid item ID")
 		}
 
-		guid := r.Form.Get("guid")
-		link := r.Form.Get("link")
+		accountID, err := strconv.ParseInt(r.Form.Get("account"), 10, 64)
+		if err != nil {
+			return clientError(http.StatusBadRequest, "Invalid account ID")
+		}
+
+		user, ok, err := store.accountByID(accountID)
+		if err != nil {
+			return err
+		}
 
-		log.Printf("guid = %q, link = %q", guid, link)
+		page := r.Form.Get("page")
+		if !ok || !hmac.Equal([]byte(r.Form.Get("sig")), []byte(clickSignature(user, guid, page))) {
+			return clientError(http.StatusForbidden, "Invalid link")
+		}
 
-		if _, err := db.Exec(`
-			UPDATE item
-			SET judgement = TRUE
-			WHERE guid = $1
-		`, guid); err != nil {
-			panic(err)
+		item, err := store.loadItem(user.ID, guid)
+		if err == sql.ErrNoRows {
+			return clientError(http.StatusNotFound, "Not found")
+		} else if err != nil {
+			return err
+		}
+
+		if err := store.judge(user.ID, guid, actionClick, false, page); err != nil {
+			return err
+		}
+
+		if arch != nil {
+			arch.saveInBackground(guid, item.Link)
 		}
 
 		//trainingDebouncer.ping()
 
-		http.Redirect(w, r, link, http.StatusMovedPermanently)
+		// Each click has to reach the server to be recorded, so the redirect
+		// must not be cached.
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, item.Link, http.StatusFound)
+		return nil
 	})
 
-	http.HandleFunc("/submit", func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseForm(); err != nil {
-			panic(err)
+	handle("/item/", func(w http.ResponseWriter, r *http.Request) error {
+		guid, err := guidFromID(strings.TrimPrefix(r.URL.Path, "/item/"))
+		if err != nil {
+			return clientError(http.StatusNotFound, "Not found")
 		}
 
-		// TODO could be more efficiently batched
-		for _, guid := range r.Form["guid"] {
-			if _, err := db.Exec(`
-				UPDATE item
-				SET judgement = FALSE
-				WHERE guid = $1 AND judgement IS NULL
-			`, guid); err != nil {
-				panic(err)
+		user := accountFrom(r)
+
+		item, err := store.loadItem(user.ID, guid)
+		if err == sql.ErrNoRows {
+			return clientError(http.StatusNotFound, "Not found")
+		} else if err != nil {
+			return err
+		}
+
+		log.Printf("Reading %q", guid)
+
+		// Only a signed link records a click, as for /click, so that a link
+		// to the reader view made anywhere else records nothing.
+		page := r.URL.Query().Get("page")
+		if hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(clickSignature(user, guid, page))) {
+			if err := store.judge(user.ID, guid, actionClick, false, page); err != nil {
+				return err
 			}
 		}
 
-		//trainingDebouncer.ping()
+		a, ok, err := store.loadArticle(guid)
+		if err != nil {
+			return err
+		}
+
+		// Items with a canonical link link to a web page, which is fetched
+		// from the link itself, as the canonical one need not be served.
+		if !ok && item.Canonical != "" {
+			if a, err = fetchArticle(item.Link); err != nil {
+				log.Printf("Fetching article for %q: %s", guid, err)
+			} else if err := store.storeArticle(guid, a); err != nil {
+				return err
+			}
+		}
+
+		var archived bool
+		if arch != nil {
+			archived, err = arch.has(guid)
+			if err != nil {
+				return err
+			}
+
+			if !archived {
+				arch.saveInBackground(guid, item.Link)
+			}
+		}
+
+		return render(w, templ, "reader", struct {
+			Item     feedItem
+			Article  article
+			Archived bool
+		}{
+			Item:     item,
+			Article:  a,
+			Archived: archived,
+		})
+	})
+
+	handle("/archive/", func(w http.ResponseWriter, r *http.Request) error {
+		if arch == nil {
+			return clientError(http.StatusNotFound, "Not found")
+		}
+
+		guid, err := guidFromID(strings.TrimPrefix(r.URL.Path, "/archive/"))
+		if err != nil {
+			return clientError(http.StatusNotFound, "Not found")
+		}
+
+		f, err := arch.open(guid)
+		if os.IsNotExist(err) {
+			return clientError(http.StatusNotFound, "Not found")
+		} else if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		// Snapshots have their scripts stripped, but are still foreign pages
+		// served from our origin, so forbid anything but inlined resources.
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src data:; style-src 'unsafe-inline' data:; font-src data:")
+
+		if _, err := io.Copy(w, f); err != nil {
+			log.Printf("Serving snapshot of %q: %s", guid, err)
+		}
+
+		return nil
+	})
+
+	handle("/judge", func(w http.ResponseWriter, r *http.Request) error {
+		if err := parsePost(r); err != nil {
+			return err
+		}
+
+		guid := r.PostForm.Get("guid")
+		a, ok := parseAction(r.PostForm.Get("action"))
+		if !ok {
+			return clientError(http.StatusBadRequest, "Unknown action")
+		}
+
+		log.Printf("guid = %q, action = %q", guid, a)
+
+		user := accountFrom(r)
+
+		if err := store.judge(user.ID, guid, a, false, r.PostForm.Get("page")); err == sql.ErrNoRows {
+			return clientError(http.StatusNotFound, "Not found")
+		} else if err != nil {
+			return err
+		}
+
+		if arch != nil && a == actionLove {
+			item, err := store.loadItem(user.ID, guid)
+			if err != nil {
+				log.Printf("Loading %q to archive: %s", guid, err)
+			} else {
+				arch.saveInBackground(guid, item.Link)
+			}
+		}
+
+		// Only follow local paths, so the form cannot bounce elsewhere.
+		next := r.PostForm.Get("next")
+		if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+			next = "/"
+		}
+
+		http.Redirect(w, r, next, http.StatusFound)
+		return nil
+	})
+
+	handle("/later", func(w http.ResponseWriter, r *http.Request) error {
+		items, err := store.laterItems(accountFrom(r).ID)
+		if err != nil {
+			return err
+		}
+
+		for i := range items {
+			items[i].Feeds, err = store.itemFeeds(items[i].GUID)
+			if err != nil {
+				return err
+			}
+			items[i].Reader = accountFrom(r)
+		}
+
+		return render(w, templ, "later", struct {
+			Items   []feedItem
+			Actions []actionButton
+			CSRF    string
+		}{
+			Items:   items,
+			Actions: explicitActions,
+			CSRF:    csrfToken(r),
+		})
+	})
+
+	handle("/undo", func(w http.ResponseWriter, r *http.Request) error {
+		if err := parsePost(r); err != nil {
+			return err
+		}
+
+		if _, err := store.undoLastPage(accountFrom(r).ID); err != nil {
+			return err
+		}
 
 		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
 	})
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query(`
-			SELECT guid, feed, title, link
-			FROM item
-			WHERE judgement IS NULL
-			ORDER BY score
-			LIMIT 3
-		`)
+	handle("/history", func(w http.ResponseWriter, r *http.Request) error {
+		events, err := store.recentJudgements(accountFrom(r).ID, 100)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		defer rows.Close()
 
-		classifierMutex.RLock()
-		defer classifierMutex.RUnlock()
+		return render(w, templ, "history", struct {
+			Events []judgementEvent
+			CSRF   string
+		}{
+			Events: events,
+			CSRF:   csrfToken(r),
+		})
+	})
 
-		items := make([]feedItem, 0)
-		for rows.Next() {
-			var item feedItem
+	handle("/submit", func(w http.ResponseWriter, r *http.Request) error {
+		if err := parsePost(r); err != nil {
+			return err
+		}
 
-			if err := rows.Scan(&item.GUID, &item.Feed, &item.Title, &item.Link); err != nil {
-				panic(err)
+		user := accountFrom(r)
+
+		// TODO could be more efficiently batched
+		for _, guid := range r.PostForm["guid"] {
+			if err := store.judge(user.ID, guid, actionSkip, true, r.PostForm.Get("page")); err == sql.ErrNoRows {
+				return clientError(http.StatusBadRequest, "Unknown item")
+			} else if err != nil {
+				return err
 			}
+		}
+
+		//trainingDebouncer.ping()
+
+		next := "/"
+		if rankerName := r.PostForm.Get("ranker"); rankerName != "" {
+			next += "?" + url.Values{"ranker": {rankerName}}.Encode()
+		}
+
+		http.Redirect(w, r, next, http.StatusFound)
+		return nil
+	})
 
-			item.Score = classifier.classify(classifiableString(item))
+	handle("/cluster", func(w http.ResponseWriter, r *http.Request) error {
+		if err := r.ParseForm(); err != nil {
+			return clientError(http.StatusBadRequest, "Invalid form: %s", err)
+		}
 
-			items = append(items, item)
+		items, err := store.clusterMembers(accountFrom(r).ID, r.Form.Get("id"))
+		if err != nil {
+			return err
 		}
 
-		if err := rows.Err(); err != nil {
-			panic(err)
+		for i := range items {
+			items[i].Feeds, err = store.itemFeeds(items[i].GUID)
+			if err != nil {
+				return err
+			}
+			items[i].Reader = accountFrom(r)
 		}
 
-		if err := templ.ExecuteTemplate(w, "index", struct {
-			Items  []feedItem
-			Shown  int
-			Elided int
+		return render(w, templ, "cluster", struct {
+			Items []feedItem
 		}{
 			Items: items,
-			Shown: len(items),
-		}); err != nil {
-			panic(err)
+		})
+	})
+
+	handle("/", func(w http.ResponseWriter, r *http.Request) error {
+		if err := r.ParseForm(); err != nil {
+			return clientError(http.StatusBadRequest, "Invalid form: %s", err)
+		}
+
+		rankerName := r.Form.Get("ranker")
+		if rankerName == "" {
+			rankerName = defaultRanker
+		}
+
+		rank, ok := rankers[rankerName]
+		if !ok {
+			return clientError(http.StatusBadRequest, "Unknown ranker")
+		}
+
+		user := accountFrom(r)
+
+		candidates, err := store.pendingCandidates(user.ID, byScore, rankingWindow)
+		if err != nil {
+			return err
+		}
+
+		rankItems(rank, candidates, time.Now())
+		if len(candidates) > cfg.Index.PageSize*candidatesPerSlot {
+			candidates = candidates[:cfg.Index.PageSize*candidatesPerSlot]
+		}
+
+		// index.explore_fraction of the page is given over to items picked
+		// to learn about rather than for their score.
+		explore := exploreSlots(cfg.Index.PageSize, cfg.Index.ExploreFraction)
+		items, elided := composePage(candidates, cfg.Index.PageSize-explore, cfg.Index.MaxPerFeed)
+
+		if explore > 0 {
+			pool, err := store.pendingCandidates(user.ID, atRandom, explore*candidatesPerSlot)
+			if err != nil {
+				return err
+			}
+
+			items = addExploration(items, pool, explore)
 		}
+
+		classifierMutex.RLock()
+		for i := range items {
+			items[i].Score = classifier.classify(classifiableString(user.ID, items[i]))
+		}
+		classifierMutex.RUnlock()
+
+		page := newPageID()
+
+		for i := range items {
+			items[i].Feeds, err = store.itemFeeds(items[i].GUID)
+			if err != nil {
+				return err
+			}
+			items[i].Page = page
+			items[i].Reader = user
+		}
+
+		if err := store.recordImpressions(user.ID, page, items, rankerName); err != nil {
+			return err
+		}
+
+		return render(w, templ, "index", struct {
+			Items   []feedItem
+			Shown   int
+			Elided  int
+			Actions []actionButton
+			Page    string
+			Ranker  string
+			Account account
+			CSRF    string
+		}{
+			Items:   items,
+			Shown:   len(items),
+			Elided:  elided,
+			Actions: explicitActions,
+			Page:    page,
+			Ranker:  r.Form.Get("ranker"),
+			Account: user,
+			CSRF:    csrfToken(r),
+		})
+	})
+
+	server := &http.Server{
+		Addr:    cfg.Listen,
+		Handler: withRequestID(requireAccount(store, pages, http.DefaultServeMux)),
+
+		// Requests are cancelled along with everything else, which ends
+		// the event streams that would otherwise hold up shutting down.
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	// Once shutting down, a second signal kills the server without waiting,
+	// and background work is told to stop.
+	server.RegisterOnShutdown(func() {
+		stopSignals()
+		cancel()
 	})
 
-	host := os.Getenv("host")
+	serve := server.ListenAndServe
+	if cfg.TLSCert != "" {
+		log.Printf("Listening with TLS on %q", server.Addr)
+		serve = func() error { return server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey) }
+	} else {
+		log.Printf("Listening on %q", server.Addr)
+	}
+
+	// Whether anything went wrong, which decides the exit status.
+	failed := false
+
+	if err := serveUntilDone(ctx, server, serve, shutdownTimeout); err != nil {
+		log.Print(err)
+		failed = true
+	}
+
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelTimeout()
+
+	if !waitTimeout(timeout, &background, arch) {
+		// Whatever is still running may be using the classifier and the
+		// store, so they are left for the exit to close.
+		log.Printf("Gave up waiting for background work after %s", shutdownTimeout)
+		os.Exit(1)
+	}
+
+	classifierMutex.Lock()
+	if err := classifier.stop(); err != nil {
+		log.Printf("Stopping classifier: %s", err)
+		failed = true
+	}
+	classifierMutex.Unlock()
+
+	if err := store.close(); err != nil {
+		log.Printf("Closing database: %s", err)
+		failed = true
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+
+	log.Printf("Shut down")
+}
+
+// How long shutting down waits for requests to finish, and then for
+// background work.
+const shutdownTimeout = 30 * time.Second
+
+// serveUntilDone calls serve, which serves with server, until it fails or ctx
+// is done.  Then it shuts server down, giving the requests in flight up to
+// timeout to finish.  It returns why serving failed, or else why shutting
+// down did.
+func serveUntilDone(ctx context.Context, server *http.Server, serve func() error, timeout time.Duration) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- serve()
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down...")
+	case serveErr := <-served:
+		err = fmt.Errorf("Serving: %s", serveErr)
+	}
 
-	log.Printf("Listening on %q", host)
-	log.Fatal(http.ListenAndServe(host, nil))
+	shutdown, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if shutdownErr := server.Shutdown(shutdown); shutdownErr != nil && err == nil {
+		err = fmt.Errorf("Stopping server: %s", shutdownErr)
+	}
+
+	return err
+}
+
+// shutdownSignals are the signals that shut the server down gracefully.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// waitTimeout waits for the goroutines in background and the archive's
+// saves, returning false if ctx is done first.  arch may be nil.
+func waitTimeout(ctx context.Context, background *sync.WaitGroup, arch *archive) bool {
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		if arch != nil {
+			arch.wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
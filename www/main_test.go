@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeUntilDoneDrains(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "finished")
+	})}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- serveUntilDone(ctx, server, func() error { return server.Serve(l) }, 5*time.Second)
+	}()
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- response{string(body), err}
+	}()
+
+	<-started
+	cancel()
+
+	// Shutting down waits for the request in flight.
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stopped with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	select {
+	case resp := <-responses:
+		if resp.err != nil {
+			t.Errorf("Request in flight failed: %s", resp.err)
+		} else if resp.body != "finished" {
+			t.Errorf("Got body %q for the request in flight, want finished", resp.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request in flight never finished")
+	}
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Got error %s shutting down", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Never stopped")
+	}
+
+	// Nothing is served once it has stopped.
+	if _, err := http.Get("http://" + l.Addr().String() + "/"); err == nil {
+		t.Error("Request after shutting down succeeded")
+	}
+}
+
+func TestServeUntilDoneFails(t *testing.T) {
+	server := &http.Server{}
+	err := serveUntilDone(context.Background(), server, func() error {
+		return errors.New("address in use")
+	}, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "address in use") {
+		t.Errorf("Got error %v, want the one serving failed with", err)
+	}
+}
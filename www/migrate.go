@@ -0,0 +1,252 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the schema of each backend as numbered migrations,
+// migrations/<dialect>/NNN_name.sql, applied in order.  Migrations only go
+// up: a change to the schema is a new file, never an edit to an applied one.
+// Beside them, migrations/<dialect>/baseline.sql upgrades a database set up
+// from schema.sql before there were migrations.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrations returns the migrations for dialect, in order.
+func migrations(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []migration
+	for _, entry := range entries {
+		if entry.Name() == baselineFile {
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		i := strings.Index(name, "_")
+		if i < 0 || name == entry.Name() {
+			return nil, fmt.Errorf("Migration %s is not named NNN_name.sql", entry.Name())
+		}
+
+		version, err := strconv.Atoi(name[:i])
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("Migration %s does not start with a version number", entry.Name())
+		}
+
+		data, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		ms = append(ms, migration{version: version, name: name[i+1:], sql: string(data)})
+	}
+
+	sort.Slice(ms, func(i, j int) bool { return ms[i].version < ms[j].version })
+	for i, m := range ms {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("Migrations for %s skip or repeat version %d", dialect, i+1)
+		}
+	}
+
+	return ms, nil
+}
+
+const baselineFile = "baseline.sql"
+
+// The columns of item in schema.sql, from before there were migrations, and
+// in the first migration.  A database with no schema version whose item has
+// neither is refused rather than guessed at.
+var (
+	baselineItemColumns = []string{"feed", "guid", "judgement", "link", "score", "title"}
+	initialItemColumns  = []string{"action", "canonical", "cluster", "duplicate_of", "explored", "feed", "guid", "judgement", "link", "published", "score", "title"}
+)
+
+// itemColumns returns the names of item's columns sorted, or none if there
+// is no item table.
+func (s *sqlStore) itemColumns() ([]string, error) {
+	query := `
+		SELECT column_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'item'
+	`
+	if s.dialect == "sqlite" {
+		query = `
+			SELECT name
+			FROM pragma_table_info('item')
+		`
+	}
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+
+	sort.Strings(columns)
+	return columns, rows.Err()
+}
+
+// isBaseline reports whether a database with no schema version was set up
+// from schema.sql, and so needs baseline.sql before the first migration.
+func (s *sqlStore) isBaseline() (bool, error) {
+	columns, err := s.itemColumns()
+	if err != nil {
+		return false, fmt.Errorf("Reading columns of item: %s", err)
+	}
+
+	switch strings.Join(columns, ",") {
+	case "", strings.Join(initialItemColumns, ","):
+		return false, nil
+	case strings.Join(baselineItemColumns, ","):
+		return true, nil
+	default:
+		return false, fmt.Errorf("The database has no schema version, but its item table has columns %s, which are neither schema.sql's nor the first migration's", strings.Join(columns, ", "))
+	}
+}
+
+// schemaVersion returns the version of the last migration applied to the
+// database, or 0 if none has been.
+func (s *sqlStore) schemaVersion() (int, error) {
+	if _, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version  INT NOT NULL PRIMARY KEY,
+			applied  TIMESTAMP NOT NULL
+		)
+	`); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := s.db.QueryRow(`
+		SELECT COALESCE(max(version), 0)
+		FROM schema_version
+	`).Scan(&version)
+	return version, err
+}
+
+// migrate applies the migrations the database has not had yet, each in a
+// transaction with its row in schema_version, and returns the version the
+// database is then at.
+func (s *sqlStore) migrate() (int, error) {
+	ms, err := migrations(s.dialect)
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := s.schemaVersion()
+	if err != nil {
+		return 0, fmt.Errorf("Reading schema version: %s", err)
+	}
+
+	if version > len(ms) {
+		return version, fmt.Errorf("The database is at schema version %d, newer than this server's %d", version, len(ms))
+	}
+
+	var baseline string
+	if version == 0 {
+		if ok, err := s.isBaseline(); err != nil {
+			return version, err
+		} else if ok {
+			data, err := migrationFiles.ReadFile(path.Join("migrations", s.dialect, baselineFile))
+			if err != nil {
+				return version, err
+			}
+			baseline = string(data)
+		}
+	}
+
+	for _, m := range ms[version:] {
+		log.Printf("Migrating database to version %d, %s", m.version, m.name)
+
+		tx, err := s.db.Begin()
+		if err != nil {
+			return version, err
+		}
+
+		if m.version == 1 && baseline != "" {
+			log.Printf("Upgrading database from schema.sql")
+
+			if _, err := tx.Exec(baseline); err != nil {
+				tx.Rollback()
+				return version, fmt.Errorf("Upgrading database from schema.sql: %s", err)
+			}
+		}
+
+		if _, err := tx.Exec(m.sql); err != nil {
+			tx.Rollback()
+			return version, fmt.Errorf("Applying migration %d, %s: %s", m.version, m.name, err)
+		}
+
+		if _, err := tx.Exec(`
+			INSERT INTO schema_version (version, applied)
+			VALUES ($1, $2)
+		`, m.version, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return version, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return version, fmt.Errorf("Applying migration %d, %s: %s", m.version, m.name, err)
+		}
+
+		version = m.version
+	}
+
+	return version, nil
+}
+
+// migrateCommand is "www migrate", which brings the configured database's
+// schema up to date and exits without serving, as the server would on
+// startup.
+func migrateCommand(args []string) {
+	cfg := parseCommand(commandFlags("migrate", ""), args, 0)
+
+	store, err := openStore(cfg.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.close()
+
+	from, err := store.schemaVersion()
+	if err != nil {
+		log.Fatalf("Reading schema version: %s", err)
+	}
+
+	to, err := store.migrate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if from == to {
+		fmt.Printf("Database is up to date at schema version %d\n", to)
+	} else {
+		fmt.Printf("Migrated database from schema version %d to %d\n", from, to)
+	}
+}
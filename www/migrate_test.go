@@ -0,0 +1,171 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// schema.sql from before there were migrations, in SQLite's dialect.
+const baselineSchema = `
+	CREATE TABLE item (
+		guid       TEXT NOT NULL PRIMARY KEY,
+		judgement  BOOLEAN NULL,
+		score      FLOAT NOT NULL,
+		feed       TEXT NOT NULL,
+		title      TEXT NOT NULL,
+		link       TEXT NOT NULL
+	);
+	CREATE INDEX item_judgement_idx ON item (judgement);
+	CREATE INDEX item_score_idx ON item (score);
+
+	CREATE TABLE feed (
+		name  TEXT NOT NULL,
+		link  TEXT NOT NULL
+	);
+`
+
+func openEmptyStore(t *testing.T) *sqlStore {
+	t.Helper()
+
+	st, err := openStore("sqlite:" + filepath.Join(t.TempDir(), "feed.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.close() })
+
+	return st.(*sqlStore)
+}
+
+func TestMigrateNew(t *testing.T) {
+	st := openEmptyStore(t)
+
+	ms, err := migrations(st.dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		version, err := st.migrate()
+		if err != nil {
+			t.Fatalf("Migrating %d: %s", i, err)
+		} else if version != len(ms) {
+			t.Fatalf("Migrating %d: got version %d, want %d", i, version, len(ms))
+		}
+	}
+
+	columns, err := st.itemColumns()
+	if err != nil {
+		t.Fatal(err)
+	} else if got, want := strings.Join(columns, ","), strings.Join(initialItemColumns, ","); got != want {
+		t.Errorf("Got item columns %s, want %s", got, want)
+	}
+
+	feeds, err := st.feeds()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(feeds) != 6 {
+		t.Errorf("Got %d default feeds, want 6", len(feeds))
+	}
+
+	if err := st.addFeed("xkcd", "https://example.com/feed"); err == nil {
+		t.Error("Added a second feed named xkcd")
+	}
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	st := openEmptyStore(t)
+
+	if _, err := st.db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.db.Exec(`
+		INSERT INTO item (guid, judgement, score, feed, title, link)
+		VALUES ('old', TRUE, 0.75, 'xkcd', 'Old comic', 'https://xkcd.com/1/')
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.db.Exec(`
+		INSERT INTO feed (name, link)
+		VALUES ('xkcd', 'https://xkcd.com/rss.xml'), ('xkcd', 'https://xkcd.com/atom.xml'), ('xkcd', 'https://xkcd.com/rss.xml')
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	columns, err := st.itemColumns()
+	if err != nil {
+		t.Fatal(err)
+	} else if got, want := strings.Join(columns, ","), strings.Join(initialItemColumns, ","); got != want {
+		t.Fatalf("Got item columns %s, want %s", got, want)
+	}
+
+	var judgement bool
+	var score float64
+	var canonical string
+	if err := st.db.QueryRow(`
+		SELECT judgement, score, canonical
+		FROM item
+		WHERE guid = 'old'
+	`).Scan(&judgement, &score, &canonical); err != nil {
+		t.Fatal(err)
+	}
+	if !judgement || score != 0.75 || canonical != "" {
+		t.Errorf("Got old item judgement %v, score %v, canonical %q", judgement, score, canonical)
+	}
+
+	// The baseline's feeds are kept instead of the defaults, less duplicates.
+	feeds, err := st.feeds()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(feeds) != 1 || feeds[0].Name != "xkcd" || feeds[0].Link != "https://xkcd.com/atom.xml" {
+		t.Errorf("Got feeds %v, want only xkcd's first link", feeds)
+	}
+
+	// New items need score's default, which schema.sql did not have.
+	added, err := st.insertItem(feedItem{GUID: "new", Feed: "xkcd", Title: "New comic", Link: "https://xkcd.com/2/"})
+	if err != nil {
+		t.Fatal(err)
+	} else if !added {
+		t.Error("New item was not added")
+	}
+
+	// The first account adopts the baseline's judgements.
+	a, err := createAccount(st, &classifier{zeroMode: true}, "alice", "password1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := st.judgementRecords()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(records) != 1 || records[0].Account != a.Name || records[0].GUID != "old" {
+		t.Errorf("Got judgements %v, want alice's of old", records)
+	}
+}
+
+func TestMigrateUnknown(t *testing.T) {
+	st := openEmptyStore(t)
+
+	if _, err := st.db.Exec(`
+		CREATE TABLE item (
+			guid  TEXT NOT NULL PRIMARY KEY,
+			link  TEXT NOT NULL
+		)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.migrate(); err == nil {
+		t.Fatal("Migrated an item table that is neither schema.sql's nor the first migration's")
+	}
+
+	if version, err := st.schemaVersion(); err != nil {
+		t.Fatal(err)
+	} else if version != 0 {
+		t.Errorf("Got schema version %d after refusing, want 0", version)
+	}
+}
@@ -0,0 +1,141 @@
+-- The schema for CockroachDB.  Tables are only created if they do not exist,
+-- so that databases set up by hand from schema.sql, before there were
+-- migrations, keep theirs; baseline.sql first adds what schema.sql's item
+-- lacks.  sqlite/001_initial.sql is the same for SQLite.
+
+-- judgement, action, score and explored are from before there were
+-- accounts; the first account adopts them into user_item.
+CREATE TABLE IF NOT EXISTS item (
+	guid         TEXT NOT NULL PRIMARY KEY,
+	judgement    BOOLEAN NULL,
+	action       TEXT NULL CHECK (action IN ('click', 'skip', 'not_interested', 'seen', 'later', 'love')),
+	score        FLOAT NOT NULL DEFAULT 0,
+	feed         TEXT NOT NULL,
+	title        TEXT NOT NULL,
+	link         TEXT NOT NULL,
+	canonical    TEXT NOT NULL DEFAULT '',
+	duplicate_of TEXT NULL,
+	published    TIMESTAMPTZ NOT NULL DEFAULT now(),
+	cluster      TEXT NULL,
+	explored     BOOLEAN NOT NULL DEFAULT FALSE,
+	INDEX judgement_idx (judgement),
+	INDEX action_idx (action),
+	INDEX score_idx (score),
+	INDEX canonical_idx (canonical),
+	INDEX duplicate_of_idx (duplicate_of),
+	INDEX published_idx (published),
+	INDEX cluster_idx (cluster)
+);
+
+-- account is 0 in tables below for rows from before there were accounts,
+-- which the first account adopts.
+CREATE TABLE IF NOT EXISTS judgement_event (
+	id       SERIAL PRIMARY KEY,
+	account  INT NOT NULL DEFAULT 0,
+	guid     TEXT NOT NULL,
+	action   TEXT NOT NULL,
+	created  TIMESTAMPTZ NOT NULL,
+	page     TEXT NOT NULL DEFAULT '',
+	undone   BOOLEAN NOT NULL DEFAULT FALSE,
+	explored BOOLEAN NOT NULL DEFAULT FALSE,
+	INDEX guid_idx (guid),
+	INDEX page_idx (page),
+	INDEX account_idx (account)
+);
+
+CREATE TABLE IF NOT EXISTS impression (
+	account   INT NOT NULL DEFAULT 0,
+	page      TEXT NOT NULL,
+	guid      TEXT NOT NULL,
+	position  INT NOT NULL,
+	explored  BOOLEAN NOT NULL,
+	ranker    TEXT NOT NULL DEFAULT '',
+	created   TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (page, guid)
+);
+
+CREATE TABLE IF NOT EXISTS article (
+	guid        TEXT NOT NULL PRIMARY KEY,
+	text        TEXT NOT NULL,
+	word_count  INT NOT NULL,
+	fetched     TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS snapshot (
+	guid     TEXT NOT NULL PRIMARY KEY,
+	hash     TEXT NOT NULL,
+	size     INT NOT NULL,
+	created  TIMESTAMPTZ NOT NULL,
+	INDEX hash_idx (hash)
+);
+
+CREATE TABLE IF NOT EXISTS feed (
+	name  TEXT NOT NULL,
+	link  TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS digest (
+	id       SERIAL PRIMARY KEY,
+	account  INT NOT NULL DEFAULT 0,
+	sent     TIMESTAMPTZ NOT NULL,
+	INDEX account_sent_idx (account, sent)
+);
+
+CREATE TABLE IF NOT EXISTS digest_item (
+	account  INT NOT NULL DEFAULT 0,
+	guid     TEXT NOT NULL,
+	digest   INT NOT NULL,
+	PRIMARY KEY (account, guid)
+);
+
+CREATE TABLE IF NOT EXISTS account (
+	id             SERIAL PRIMARY KEY,
+	name           TEXT NOT NULL UNIQUE,
+	password_hash  TEXT NOT NULL,
+	email          TEXT NOT NULL DEFAULT '',
+	feed_token     TEXT NOT NULL UNIQUE,
+	created        TIMESTAMPTZ NOT NULL
+);
+
+-- token is the SHA-256 of the session cookie.
+CREATE TABLE IF NOT EXISTS session (
+	token    TEXT NOT NULL PRIMARY KEY,
+	account  INT NOT NULL,
+	created  TIMESTAMPTZ NOT NULL,
+	expires  TIMESTAMPTZ NOT NULL,
+	INDEX account_idx (account)
+);
+
+-- A token an account can log in with instead of its password.  hash is the
+-- SHA-256 of the token.
+CREATE TABLE IF NOT EXISTS api_token (
+	id         SERIAL PRIMARY KEY,
+	account    INT NOT NULL,
+	name       TEXT NOT NULL,
+	hash       TEXT NOT NULL UNIQUE,
+	created    TIMESTAMPTZ NOT NULL,
+	last_used  TIMESTAMPTZ NULL,
+	INDEX account_idx (account)
+);
+
+CREATE TABLE IF NOT EXISTS subscription (
+	account  INT NOT NULL,
+	feed     TEXT NOT NULL,
+	PRIMARY KEY (account, feed),
+	INDEX feed_idx (feed)
+);
+
+-- An item offered to an account, with the account's score and judgement.
+CREATE TABLE IF NOT EXISTS user_item (
+	account    INT NOT NULL,
+	guid       TEXT NOT NULL,
+	judgement  BOOLEAN NULL,
+	action     TEXT NULL CHECK (action IN ('click', 'skip', 'not_interested', 'seen', 'later', 'love')),
+	score      FLOAT NOT NULL DEFAULT 0,
+	explored   BOOLEAN NOT NULL DEFAULT FALSE,
+	PRIMARY KEY (account, guid),
+	INDEX guid_idx (guid),
+	INDEX judgement_idx (account, judgement),
+	INDEX action_idx (account, action),
+	INDEX score_idx (account, score)
+);
@@ -0,0 +1,18 @@
+-- The feeds that were in feeds.sql, for new databases only: a database
+-- which already has feeds keeps them as they are.
+INSERT INTO feed (name, link)
+SELECT name, link
+FROM (
+	SELECT 'ejcn' AS name, 'http://feeds.nature.com/ejcn/rss/current' AS link
+	UNION ALL
+	SELECT 'high-scalability', 'https://feeds.feedburner.com/HighScalability?format=xml'
+	UNION ALL
+	SELECT 'nature', 'http://feeds.nature.com/nature/rss/current'
+	UNION ALL
+	SELECT 'reuters', 'http://feeds.reuters.com/reuters/topNews'
+	UNION ALL
+	SELECT 'slate-star-codex', 'https://slatestarcodex.com/feed'
+	UNION ALL
+	SELECT 'xkcd', 'http://xkcd.com/rss.xml'
+) AS defaults
+WHERE NOT EXISTS (SELECT 1 FROM feed);
@@ -0,0 +1,17 @@
+-- Feed names identify feeds everywhere else, but feed had no key to stop two
+-- adds racing to insert the same name.  The table has nothing else to tell
+-- copies apart by, so it is rebuilt with name as its key, keeping the first
+-- link of any name there is more than one of.
+CREATE TABLE feed_unique (
+	name  TEXT NOT NULL PRIMARY KEY,
+	link  TEXT NOT NULL
+);
+
+INSERT INTO feed_unique (name, link)
+SELECT name, min(link)
+FROM feed
+GROUP BY name;
+
+DROP TABLE feed;
+
+ALTER TABLE feed_unique RENAME TO feed;
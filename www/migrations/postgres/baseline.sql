@@ -0,0 +1,18 @@
+-- Brings a database set up by hand from schema.sql, before there were
+-- migrations, up to the tables 001_initial.sql expects, which it creates only
+-- if they do not exist.  It is applied with 001, and only to databases whose
+-- item table has schema.sql's columns.  feed is already as 001 has it.
+
+ALTER TABLE item ADD COLUMN action TEXT NULL CHECK (action IN ('click', 'skip', 'not_interested', 'seen', 'later', 'love'));
+ALTER TABLE item ALTER COLUMN score SET DEFAULT 0;
+ALTER TABLE item ADD COLUMN canonical TEXT NOT NULL DEFAULT '';
+ALTER TABLE item ADD COLUMN duplicate_of TEXT NULL;
+ALTER TABLE item ADD COLUMN published TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE item ADD COLUMN cluster TEXT NULL;
+ALTER TABLE item ADD COLUMN explored BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS action_idx ON item (action);
+CREATE INDEX IF NOT EXISTS canonical_idx ON item (canonical);
+CREATE INDEX IF NOT EXISTS duplicate_of_idx ON item (duplicate_of);
+CREATE INDEX IF NOT EXISTS published_idx ON item (published);
+CREATE INDEX IF NOT EXISTS cluster_idx ON item (cluster);
@@ -0,0 +1,131 @@
+-- postgres/001_initial.sql for SQLite.  Times are stored as text in UTC,
+-- which the driver parses back for columns declared TIMESTAMP.
+
+CREATE TABLE IF NOT EXISTS item (
+	guid         TEXT NOT NULL PRIMARY KEY,
+	judgement    BOOLEAN NULL,
+	action       TEXT NULL CHECK (action IN ('click', 'skip', 'not_interested', 'seen', 'later', 'love')),
+	score        FLOAT NOT NULL DEFAULT 0,
+	feed         TEXT NOT NULL,
+	title        TEXT NOT NULL,
+	link         TEXT NOT NULL,
+	canonical    TEXT NOT NULL DEFAULT '',
+	duplicate_of TEXT NULL,
+	published    TIMESTAMP NOT NULL,
+	cluster      TEXT NULL,
+	explored     BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX IF NOT EXISTS item_judgement_idx ON item (judgement);
+CREATE INDEX IF NOT EXISTS item_action_idx ON item (action);
+CREATE INDEX IF NOT EXISTS item_score_idx ON item (score);
+CREATE INDEX IF NOT EXISTS item_canonical_idx ON item (canonical);
+CREATE INDEX IF NOT EXISTS item_duplicate_of_idx ON item (duplicate_of);
+CREATE INDEX IF NOT EXISTS item_published_idx ON item (published);
+CREATE INDEX IF NOT EXISTS item_cluster_idx ON item (cluster);
+
+CREATE TABLE IF NOT EXISTS judgement_event (
+	id       INTEGER PRIMARY KEY,
+	account  INT NOT NULL DEFAULT 0,
+	guid     TEXT NOT NULL,
+	action   TEXT NOT NULL,
+	created  TIMESTAMP NOT NULL,
+	page     TEXT NOT NULL DEFAULT '',
+	undone   BOOLEAN NOT NULL DEFAULT FALSE,
+	explored BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX IF NOT EXISTS judgement_event_guid_idx ON judgement_event (guid);
+CREATE INDEX IF NOT EXISTS judgement_event_page_idx ON judgement_event (page);
+CREATE INDEX IF NOT EXISTS judgement_event_account_idx ON judgement_event (account);
+
+CREATE TABLE IF NOT EXISTS impression (
+	account   INT NOT NULL DEFAULT 0,
+	page      TEXT NOT NULL,
+	guid      TEXT NOT NULL,
+	position  INT NOT NULL,
+	explored  BOOLEAN NOT NULL,
+	ranker    TEXT NOT NULL DEFAULT '',
+	created   TIMESTAMP NOT NULL,
+	PRIMARY KEY (page, guid)
+);
+
+CREATE TABLE IF NOT EXISTS article (
+	guid        TEXT NOT NULL PRIMARY KEY,
+	text        TEXT NOT NULL,
+	word_count  INT NOT NULL,
+	fetched     TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS snapshot (
+	guid     TEXT NOT NULL PRIMARY KEY,
+	hash     TEXT NOT NULL,
+	size     INT NOT NULL,
+	created  TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS snapshot_hash_idx ON snapshot (hash);
+
+CREATE TABLE IF NOT EXISTS feed (
+	name  TEXT NOT NULL,
+	link  TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS digest (
+	id       INTEGER PRIMARY KEY,
+	account  INT NOT NULL DEFAULT 0,
+	sent     TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS digest_account_sent_idx ON digest (account, sent);
+
+CREATE TABLE IF NOT EXISTS digest_item (
+	account  INT NOT NULL DEFAULT 0,
+	guid     TEXT NOT NULL,
+	digest   INT NOT NULL,
+	PRIMARY KEY (account, guid)
+);
+
+CREATE TABLE IF NOT EXISTS account (
+	id             INTEGER PRIMARY KEY,
+	name           TEXT NOT NULL UNIQUE,
+	password_hash  TEXT NOT NULL,
+	email          TEXT NOT NULL DEFAULT '',
+	feed_token     TEXT NOT NULL UNIQUE,
+	created        TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS session (
+	token    TEXT NOT NULL PRIMARY KEY,
+	account  INT NOT NULL,
+	created  TIMESTAMP NOT NULL,
+	expires  TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS session_account_idx ON session (account);
+
+CREATE TABLE IF NOT EXISTS api_token (
+	id         INTEGER PRIMARY KEY,
+	account    INT NOT NULL,
+	name       TEXT NOT NULL,
+	hash       TEXT NOT NULL UNIQUE,
+	created    TIMESTAMP NOT NULL,
+	last_used  TIMESTAMP NULL
+);
+CREATE INDEX IF NOT EXISTS api_token_account_idx ON api_token (account);
+
+CREATE TABLE IF NOT EXISTS subscription (
+	account  INT NOT NULL,
+	feed     TEXT NOT NULL,
+	PRIMARY KEY (account, feed)
+);
+CREATE INDEX IF NOT EXISTS subscription_feed_idx ON subscription (feed);
+
+CREATE TABLE IF NOT EXISTS user_item (
+	account    INT NOT NULL,
+	guid       TEXT NOT NULL,
+	judgement  BOOLEAN NULL,
+	action     TEXT NULL CHECK (action IN ('click', 'skip', 'not_interested', 'seen', 'later', 'love')),
+	score      FLOAT NOT NULL DEFAULT 0,
+	explored   BOOLEAN NOT NULL DEFAULT FALSE,
+	PRIMARY KEY (account, guid)
+);
+CREATE INDEX IF NOT EXISTS user_item_guid_idx ON user_item (guid);
+CREATE INDEX IF NOT EXISTS user_item_judgement_idx ON user_item (account, judgement);
+CREATE INDEX IF NOT EXISTS user_item_action_idx ON user_item (account, action);
+CREATE INDEX IF NOT EXISTS user_item_score_idx ON user_item (account, score);
@@ -0,0 +1,28 @@
+-- postgres/baseline.sql for SQLite, which cannot give score a default in
+-- place, so item is copied into a new table instead.  Its indexes are
+-- dropped with the old table and made again by 001_initial.sql.  Items
+-- from before there were publication times are taken to be published now,
+-- as in CockroachDB.
+
+ALTER TABLE item RENAME TO baseline_item;
+
+CREATE TABLE item (
+	guid         TEXT NOT NULL PRIMARY KEY,
+	judgement    BOOLEAN NULL,
+	action       TEXT NULL CHECK (action IN ('click', 'skip', 'not_interested', 'seen', 'later', 'love')),
+	score        FLOAT NOT NULL DEFAULT 0,
+	feed         TEXT NOT NULL,
+	title        TEXT NOT NULL,
+	link         TEXT NOT NULL,
+	canonical    TEXT NOT NULL DEFAULT '',
+	duplicate_of TEXT NULL,
+	published    TIMESTAMP NOT NULL,
+	cluster      TEXT NULL,
+	explored     BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+INSERT INTO item (guid, judgement, score, feed, title, link, published)
+SELECT guid, judgement, score, feed, title, link, CURRENT_TIMESTAMP
+FROM baseline_item;
+
+DROP TABLE baseline_item;
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Models are trained into candidates beside model.path, named after it with
+// the time they were trained, such as model-20060102T150405.bin, each with
+// its vectors in the .vec file of the same name.  model.path itself is a
+// symbolic link to the candidate in use, which promoteModel changes.
+
+type modelFile struct {
+	Path     string
+	Size     int64
+	Modified time.Time
+
+	// Live is set for the model at model.path, which the server loads.
+	Live bool
+}
+
+func candidatePath(modelPath string, trained time.Time) string {
+	ext := filepath.Ext(modelPath)
+	return strings.TrimSuffix(modelPath, ext) + "-" + trained.UTC().Format("20060102T150405") + ext
+}
+
+func vecPath(modelPath string) string {
+	return strings.TrimSuffix(modelPath, filepath.Ext(modelPath)) + ".vec"
+}
+
+// listModels returns the candidates beside modelPath, oldest first.  A model
+// installed at modelPath before there were candidates is listed as itself.
+func listModels(modelPath string) ([]modelFile, error) {
+	ext := filepath.Ext(modelPath)
+	paths, err := filepath.Glob(strings.TrimSuffix(modelPath, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+
+	live, err := os.Readlink(modelPath)
+	if os.IsNotExist(err) {
+		live = ""
+	} else if err != nil {
+		// Not a link, so a model from before there were candidates.
+		paths = append([]string{modelPath}, paths...)
+		live = filepath.Base(modelPath)
+	}
+
+	models := make([]modelFile, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		models = append(models, modelFile{
+			Path:     path,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+			Live:     filepath.Base(path) == live,
+		})
+	}
+
+	return models, nil
+}
+
+// findModel returns the candidate for modelPath named name, which may be its
+// path or just its file name.
+func findModel(modelPath, name string) (modelFile, error) {
+	models, err := listModels(modelPath)
+	if err != nil {
+		return modelFile{}, err
+	}
+
+	for _, m := range models {
+		if m.Path == name || filepath.Base(m.Path) == name {
+			return m, nil
+		}
+	}
+
+	return modelFile{}, fmt.Errorf("No model named %q beside %s", name, modelPath)
+}
+
+// promoteModel makes the candidate at path the model at modelPath.  A model
+// installed at modelPath before there were candidates is kept as a
+// candidate.  Running servers go on using the model they loaded until they
+// are restarted.
+func promoteModel(modelPath, path string) error {
+	if info, err := os.Lstat(modelPath); err == nil && info.Mode().IsRegular() {
+		old := candidatePath(modelPath, info.ModTime())
+		if err := os.Rename(modelPath, old); err != nil {
+			return err
+		}
+		if err := os.Rename(vecPath(modelPath), vecPath(old)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for _, link := range []struct{ path, target string }{
+		{modelPath, path},
+		{vecPath(modelPath), vecPath(path)},
+	} {
+		// Replace the link in one step, so the server never finds it missing.
+		temp := link.path + ".new"
+		os.Remove(temp)
+		if err := os.Symlink(filepath.Base(link.target), temp); err != nil {
+			return err
+		}
+		if err := os.Rename(temp, link.path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
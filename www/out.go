@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// outFeed selects the items published in an account's filtered output feeds:
+// every item it has not judged scoring at least threshold for it, or, if
+// topPerDay is set, only the best topPerDay of each day's items.  Links are
+// made absolute with baseURL, or with the host the feed was requested from
+// if it is empty.
+type outFeed struct {
+	store     Store
+	baseURL   string
+	threshold float64
+	topPerDay int
+}
+
+// How far back the output feeds reach.
+const outFeedWindow = 14 * 24 * time.Hour
+
+func (o *outFeed) items(accountID int64) ([]feedItem, error) {
+	scored, err := o.store.outItems(accountID, time.Now().Add(-outFeedWindow), o.threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]feedItem, 0)
+	perDay := make(map[string]int)
+	for _, item := range scored {
+		if o.topPerDay > 0 {
+			day := item.Published.UTC().Format("2006-01-02")
+			if perDay[day] >= o.topPerDay {
+				continue
+			}
+			perDay[day]++
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// outItems returns the items the account has not judged that were
+// published after since and score at least threshold for it, newest and then
+// best first.
+func (s *sqlStore) outItems(accountID int64, since time.Time, threshold float64) ([]feedItem, error) {
+	rows, err := s.db.Query(`
+		SELECT item.guid, item.feed, item.title, item.link, item.canonical, user_item.score, item.published
+		FROM item
+		JOIN user_item ON user_item.guid = item.guid AND user_item.account = $1
+		WHERE `+pendingCondition+` AND item.duplicate_of IS NULL AND item.published > $2 AND user_item.score >= $3
+		ORDER BY item.published DESC, user_item.score DESC
+	`, accountID, since.UTC(), threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []feedItem
+	for rows.Next() {
+		var item feedItem
+		if err := rows.Scan(&item.GUID, &item.Feed, &item.Title, &item.Link, &item.Canonical, &item.Score, &item.Published); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (o *outFeed) base(r *http.Request) string {
+	if o.baseURL != "" {
+		return strings.TrimRight(o.baseURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title    string   `xml:"title"`
+	ID       string   `xml:"id"`
+	Link     atomLink `xml:"link"`
+	Updated  string   `xml:"updated"`
+	Category struct {
+		Term string `xml:"term,attr"`
+	} `xml:"category"`
+	Summary string `xml:"summary"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func (o *outFeed) serveAtom(w http.ResponseWriter, r *http.Request) error {
+	items, err := o.items(accountFrom(r).ID)
+	if err != nil {
+		return err
+	}
+
+	base := o.base(r)
+
+	feed := atomFeed{
+		Title: "feed",
+		ID:    base + "/out/atom.xml",
+		Links: []atomLink{
+			{Href: base + "/out/atom.xml", Rel: "self"},
+			{Href: base + "/"},
+		},
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  "feed",
+	}
+
+	for _, item := range items {
+		// Links go through /click so that following them from a feed
+		// reader records a judgement like following them from the index.
+		item.Base = base
+		item.Reader = accountFrom(r)
+		entry := atomEntry{
+			Title:   item.Title,
+			ID:      item.GUID,
+			Link:    atomLink{Href: item.ClickURL()},
+			Updated: item.Published.UTC().Format(time.RFC3339),
+			Summary: item.Feed,
+		}
+		entry.Category.Term = item.Feed
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	return writeXML(w, feed)
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink string `xml:"isPermaLink,attr"`
+}
+
+type rssItem struct {
+	Title    string  `xml:"title"`
+	Link     string  `xml:"link"`
+	GUID     rssGUID `xml:"guid"`
+	PubDate  string  `xml:"pubDate"`
+	Category string  `xml:"category"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	Channel struct {
+		Title       string    `xml:"title"`
+		Link        string    `xml:"link"`
+		Description string    `xml:"description"`
+		Items       []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+func (o *outFeed) serveRSS(w http.ResponseWriter, r *http.Request) error {
+	items, err := o.items(accountFrom(r).ID)
+	if err != nil {
+		return err
+	}
+
+	base := o.base(r)
+
+	feed := rssFeed{Version: "2.0"}
+	feed.Channel.Title = "feed"
+	feed.Channel.Link = base + "/"
+	feed.Channel.Description = "Items filtered by learned taste"
+
+	for _, item := range items {
+		item.Base = base
+		item.Reader = accountFrom(r)
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:    item.Title,
+			Link:     item.ClickURL(),
+			GUID:     rssGUID{Value: item.GUID, IsPermaLink: "false"},
+			PubDate:  item.Published.UTC().Format(time.RFC1123Z),
+			Category: item.Feed,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	return writeXML(w, feed)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) error {
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "\t")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ranker decides the order in which candidates are offered for the index
+// page.  Rankers are named so that the one used can be chosen per request and
+// recorded with each impression, to compare how well they do.
+type ranker interface {
+	rank(item feedItem, now time.Time) float64
+}
+
+// scoreRanker ranks items by the classifier's score alone.
+type scoreRanker struct{}
+
+func (scoreRanker) rank(item feedItem, now time.Time) float64 {
+	return item.Score
+}
+
+// decayRanker ranks items by score, halved for every halfLife since they were
+// published, so that old items eventually give way to new ones.
+type decayRanker struct {
+	halfLife time.Duration
+}
+
+func (r decayRanker) rank(item feedItem, now time.Time) float64 {
+	age := now.Sub(item.Published)
+	if age < 0 {
+		age = 0
+	}
+	return item.Score * math.Pow(0.5, float64(age)/float64(r.halfLife))
+}
+
+// feedBoostRanker ranks items by score multiplied by a per-feed boost, or
+// 1 for feeds without one.
+type feedBoostRanker struct {
+	boosts map[string]float64
+}
+
+func (r feedBoostRanker) rank(item feedItem, now time.Time) float64 {
+	if boost, ok := r.boosts[item.Feed]; ok {
+		return item.Score * boost
+	}
+	return item.Score
+}
+
+// newRankers returns every ranker by the name it is chosen and recorded by.
+func newRankers(halfLife time.Duration, boosts map[string]float64) map[string]ranker {
+	return map[string]ranker{
+		"score": scoreRanker{},
+		"decay": decayRanker{halfLife: halfLife},
+		"boost": feedBoostRanker{boosts: boosts},
+	}
+}
+
+// parseFeedBoosts parses boosts written as "feed=1.5,other-feed=0.5".
+func parseFeedBoosts(s string) (map[string]float64, error) {
+	boosts := make(map[string]float64)
+	for _, field := range strings.Split(s, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Feed boost %q is not of the form feed=boost", field)
+		}
+
+		boost, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Feed boost %q: %s", field, err)
+		}
+
+		boosts[strings.TrimSpace(parts[0])] = boost
+	}
+	return boosts, nil
+}
+
+// rankItems sorts items best first according to r.
+func rankItems(r ranker, items []feedItem, now time.Time) {
+	ranks := make(map[string]float64, len(items))
+	for _, item := range items {
+		ranks[item.GUID] = r.rank(item, now)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return ranks[items[i].GUID] > ranks[items[j].GUID]
+	})
+}
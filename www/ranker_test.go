@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRankItems(t *testing.T) {
+	now := time.Now()
+	items := func() []feedItem {
+		return []feedItem{
+			{GUID: "old", Feed: "a", Score: 0.9, Published: now.Add(-72 * time.Hour)},
+			{GUID: "new", Feed: "b", Score: 0.6, Published: now},
+			{GUID: "tie", Feed: "a", Score: 0.6, Published: now},
+			{GUID: "low", Feed: "c", Score: 0.3, Published: now},
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		ranker ranker
+		want   []string
+	}{
+		// Ties keep their order.
+		{"score", scoreRanker{}, []string{"old", "new", "tie", "low"}},
+		{"decay", decayRanker{halfLife: 24 * time.Hour}, []string{"new", "tie", "low", "old"}},
+		{"feed boost", feedBoostRanker{boosts: map[string]float64{"c": 3, "a": 0.5}}, []string{"low", "new", "old", "tie"}},
+	} {
+		ranked := items()
+		rankItems(test.ranker, ranked, now)
+		if !sameGUIDs(ranked, test.want...) {
+			t.Errorf("%s ranked %v, want %v", test.name, guids(ranked), test.want)
+		}
+	}
+}
+
+func TestParseFeedBoosts(t *testing.T) {
+	boosts, err := parseFeedBoosts(" xkcd = 1.5, nature=0.5,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(boosts) != 2 || boosts["xkcd"] != 1.5 || boosts["nature"] != 0.5 {
+		t.Errorf("Got boosts %v", boosts)
+	}
+
+	if boosts, err := parseFeedBoosts(""); err != nil || len(boosts) != 0 {
+		t.Errorf("Got boosts %v, %v for none", boosts, err)
+	}
+
+	for _, s := range []string{"xkcd", "xkcd=lots", "xkcd=1.5,nature"} {
+		if _, err := parseFeedBoosts(s); err == nil {
+			t.Errorf("Parsed feed boosts %q", s)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// ID encodes the item's guid, which is usually itself a URL, so that it can
+// be used as a single path segment.
+func (item feedItem) ID() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(item.GUID))
+}
+
+func guidFromID(id string) (string, error) {
+	guid, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return "", err
+	}
+	return string(guid), nil
+}
+
+// ClickURL is the link through /click which records that the Reader opened
+// the item before redirecting to it.  It names only the item, whose link
+// /click looks up, and is signed for the Reader, so that it needs no session
+// and a link to /click made anywhere else records nothing.
+func (item feedItem) ClickURL() string {
+	values := url.Values{
+		"id":      {item.ID()},
+		"account": {strconv.FormatInt(item.Reader.ID, 10)},
+		"sig":     {clickSignature(item.Reader, item.GUID, item.Page)},
+	}
+	if item.Page != "" {
+		values.Set("page", item.Page)
+	}
+	return item.Base + "/click?" + values.Encode()
+}
+
+// ReaderURL is the link to the item in the reader view, which records that
+// the Reader opened it only if the link is signed for them as ClickURL is.
+func (item feedItem) ReaderURL() string {
+	values := url.Values{
+		"sig": {clickSignature(item.Reader, item.GUID, item.Page)},
+	}
+	if item.Page != "" {
+		values.Set("page", item.Page)
+	}
+	return item.Base + "/item/" + item.ID() + "?" + values.Encode()
+}
+
+// clickSignature signs a click on guid from page for the account, with a
+// key only the site and the account's feed readers have.
+func clickSignature(a account, guid, page string) string {
+	mac := hmac.New(sha256.New, []byte(a.FeedToken))
+	fmt.Fprintf(mac, "click\x00%s\x00%s", guid, page)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Original is the link to the story itself.
+func (item feedItem) Original() string {
+	if item.Canonical != "" {
+		return item.Canonical
+	}
+	return item.Link
+}
+
+// Discussion is the link to the page discussing the story, such as its
+// Hacker News comments, or "" if the item links straight to the story.
+func (item feedItem) Discussion() string {
+	if item.Canonical == "" {
+		return ""
+	}
+
+	link, err := url.Parse(canonicalizeURL(item.Link))
+	if err != nil {
+		return ""
+	}
+
+	original, err := url.Parse(item.Canonical)
+	if err != nil || original.Host == link.Host {
+		return ""
+	}
+
+	return item.Link
+}
+
+// loadItem returns the item with the given guid, scored for the account, or
+// sql.ErrNoRows.
+func (s *sqlStore) loadItem(accountID int64, guid string) (feedItem, error) {
+	var item feedItem
+	err := s.db.QueryRow(`
+		SELECT item.guid, item.feed, item.title, item.link, item.canonical, COALESCE(user_item.score, 0), item.published
+		FROM item
+		LEFT JOIN user_item ON user_item.guid = item.guid AND user_item.account = $2
+		WHERE item.guid = $1
+	`, guid, accountID).Scan(&item.GUID, &item.Feed, &item.Title, &item.Link, &item.Canonical, &item.Score, &item.Published)
+	return item, err
+}
+
+// laterItems returns the items the account saved for later, newest first.
+func (s *sqlStore) laterItems(accountID int64) ([]feedItem, error) {
+	rows, err := s.db.Query(`
+		SELECT item.guid, item.feed, item.title, item.link, user_item.score
+		FROM item
+		JOIN user_item ON user_item.guid = item.guid AND user_item.account = $1
+		WHERE user_item.action = $2 AND item.duplicate_of IS NULL
+		ORDER BY item.published DESC
+	`, accountID, actionLater)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]feedItem, 0)
+	for rows.Next() {
+		var item feedItem
+		if err := rows.Scan(&item.GUID, &item.Feed, &item.Title, &item.Link, &item.Score); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// clusterMembers returns the items in the cluster named cluster, newest
+// first, scored for the account.
+func (s *sqlStore) clusterMembers(accountID int64, cluster string) ([]feedItem, error) {
+	rows, err := s.db.Query(`
+		SELECT item.guid, item.feed, item.title, item.link, COALESCE(user_item.score, 0)
+		FROM item
+		LEFT JOIN user_item ON user_item.guid = item.guid AND user_item.account = $2
+		WHERE (item.cluster = $1 OR item.guid = $1) AND item.duplicate_of IS NULL
+		ORDER BY item.published DESC
+	`, cluster, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]feedItem, 0)
+	for rows.Next() {
+		var item feedItem
+		if err := rows.Scan(&item.GUID, &item.Feed, &item.Title, &item.Link, &item.Score); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestClickURL(t *testing.T) {
+	alice := account{ID: 1, FeedToken: "alice's token"}
+	item := feedItem{GUID: "https://example.com/story", Page: "p1", Base: "https://feed.example", Reader: alice}
+
+	u, err := url.Parse(item.ClickURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "https" || u.Host != "feed.example" || u.Path != "/click" {
+		t.Errorf("Got click URL %s, want it on https://feed.example/click", u)
+	}
+
+	q := u.Query()
+	if guid, err := guidFromID(q.Get("id")); err != nil || guid != item.GUID {
+		t.Errorf("Got guid %q, %v from the link, want %q", guid, err, item.GUID)
+	}
+	if q.Get("account") != "1" || q.Get("page") != "p1" {
+		t.Errorf("Got account %q and page %q from the link", q.Get("account"), q.Get("page"))
+	}
+	if q.Get("sig") != clickSignature(alice, item.GUID, "p1") {
+		t.Error("Link is not signed for its reader")
+	}
+
+	// Signatures are only good for the account, item and page signed.
+	for _, other := range []string{
+		clickSignature(account{ID: 1, FeedToken: "bob's token"}, item.GUID, "p1"),
+		clickSignature(alice, "https://example.com/other", "p1"),
+		clickSignature(alice, item.GUID, "p2"),
+		clickSignature(alice, item.GUID, ""),
+	} {
+		if other == q.Get("sig") {
+			t.Error("Got the same signature for a different click")
+		}
+	}
+}
+
+func TestReaderURL(t *testing.T) {
+	alice := account{ID: 1, FeedToken: "alice's token"}
+	item := feedItem{GUID: "https://example.com/story", Page: "p1", Reader: alice}
+
+	u, err := url.Parse(item.ReaderURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/item/"+item.ID() {
+		t.Errorf("Got reader URL %s, want it on /item/%s", u, item.ID())
+	}
+
+	q := u.Query()
+	if q.Get("page") != "p1" || q.Get("sig") != clickSignature(alice, item.GUID, "p1") {
+		t.Errorf("Got page %q and sig %q, want the link signed for its reader", q.Get("page"), q.Get("sig"))
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"github.com/mmcdole/gofeed"
 	"log"
 	"math/rand"
@@ -25,42 +25,58 @@ func scrapeFeed(link string) ([]feedItem, error) {
 			i.GUID = i.Link
 		}
 
+		published := time.Now()
+		if i.PublishedParsed != nil {
+			published = *i.PublishedParsed
+		} else if i.UpdatedParsed != nil {
+			published = *i.UpdatedParsed
+		}
+
 		items = append(items, feedItem{
-			GUID:  i.GUID,
-			Link:  i.Link,
-			Title: i.Title,
+			GUID:      i.GUID,
+			Link:      i.Link,
+			Title:     i.Title,
+			Canonical: canonicalizeURL(i.Link),
+			Published: published,
 		})
 	}
 
 	return items, nil
 }
 
-func refresh(classifier *classifier, db *sql.DB) error {
-	log.Printf("Refreshing")
-	defer log.Printf("Done refreshing")
-
-	rows, err := db.Query(`
-		SELECT name, link
-		FROM feed
-	`)
+// refresh scrapes every feed, scores the items it has not seen before for
+// every account subscribed to the feed and publishes them to events as they
+// are inserted.  Once ctx is done, it finishes the items it is inserting and
+// returns ctx's error.
+func refresh(ctx context.Context, classifier *classifier, st Store, events *broker) error {
+	feeds, err := st.feeds()
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
+
+	return refreshFeeds(ctx, classifier, st, events, feeds)
+}
+
+// refreshFeeds is refresh for only the given feeds.  events may be nil.
+func refreshFeeds(ctx context.Context, classifier *classifier, st Store, events *broker, feeds []feedSource) error {
+	log.Printf("Refreshing")
+	defer log.Printf("Done refreshing")
 
 	var group sync.WaitGroup
 	defer group.Wait()
 
-	for rows.Next() {
-		var feed, link string
-		if err := rows.Scan(&feed, &link); err != nil {
-			return err
-		}
+	for _, f := range feeds {
+		feed, link := f.Name, f.Link
 
 		group.Add(1)
 		go func() {
 			defer group.Done()
-			time.Sleep(time.Duration(rand.Intn(2000)) * time.Millisecond)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(rand.Intn(2000)) * time.Millisecond):
+			}
 
 			parsedLink, err := url.Parse(link)
 			if err != nil {
@@ -82,26 +98,129 @@ func refresh(classifier *classifier, db *sql.DB) error {
 				log.Printf("Scraping %q: %s", link, err)
 			}
 
+			accounts, err := st.subscribers(feed)
+			if err != nil {
+				log.Printf("Listing subscribers of %q: %s", feed, err)
+				return
+			}
+
 			for _, item := range items {
-				log.Printf("Scoring %v", item)
-				score := classifier.classify(classifiableString(item))
-				log.Printf("Got score %f", score)
+				if ctx.Err() != nil {
+					return
+				}
+
+				if exists, err := st.itemExists(item.GUID); err != nil {
+					log.Printf("Checking for item %q: %s", item.GUID, err)
+					continue
+				} else if exists {
+					continue
+				}
+
+				// The link itself is fetched, since its canonicalized form
+				// need not be served at all, and keeps that form if it
+				// cannot be.
+				if item.Canonical != "" {
+					if canonical, err := resolveCanonical(item.Link); err != nil {
+						log.Printf("Resolving canonical link of %q: %s", item.Link, err)
+					} else if canonical != "" {
+						item.Canonical = canonical
+					}
+				}
 
 				log.Printf("Upserting %q", item.GUID)
-				if _, err := db.Exec(`
-					INSERT INTO item (guid, judgement, score, feed, title, link)
-					VALUES ($1, NULL, $2, $3, $4, $5)
-					ON CONFLICT (guid) DO NOTHING
-				`, item.GUID, score, feed, item.Title, item.Link); err != nil {
+				item.Feed = feed
+				if inserted, err := st.insertItem(item); err != nil {
 					log.Printf("Inserting item from feed: %s", err)
+					continue
+				} else if !inserted {
+					continue
+				}
+
+				item.Feeds = []string{feed}
+
+				isNew, err := st.isNewStory(item)
+				if err != nil {
+					log.Printf("Checking for copies of %q: %s", item.GUID, err)
+				}
+
+				for _, accountID := range accounts {
+					item.Score = classifier.classify(classifiableString(accountID, item))
+
+					if err := st.addUserItem(accountID, item, item.Score); err != nil {
+						log.Printf("Offering %q to account %d: %s", item.GUID, accountID, err)
+						continue
+					}
+
+					if isNew {
+						events.publish(accountID, item)
+					}
 				}
 			}
 		}()
 	}
 
-	if err := rows.Err(); err != nil {
+	group.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := st.groupDuplicates(); err != nil {
 		return err
 	}
 
-	return nil
+	return clusterItems(st)
+}
+
+// feedSource is a feed and the link it is scraped from.
+type feedSource struct {
+	Name string
+	Link string
+}
+
+func (s *sqlStore) feeds() ([]feedSource, error) {
+	rows, err := s.db.Query(`
+		SELECT name, link
+		FROM feed
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feeds []feedSource
+	for rows.Next() {
+		var f feedSource
+		if err := rows.Scan(&f.Name, &f.Link); err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, f)
+	}
+
+	return feeds, rows.Err()
+}
+
+// itemExists reports whether an item with the given guid has been stored.
+func (s *sqlStore) itemExists(guid string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM item WHERE guid = $1)
+	`, guid).Scan(&exists)
+	return exists, err
+}
+
+// insertItem stores item, returning false if an item with its guid already
+// was.
+func (s *sqlStore) insertItem(item feedItem) (bool, error) {
+	result, err := s.db.Exec(`
+		INSERT INTO item (guid, feed, title, link, canonical, published)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (guid) DO NOTHING
+	`, item.GUID, item.Feed, item.Title, item.Link, item.Canonical, item.Published.UTC())
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := result.RowsAffected()
+	return inserted > 0, err
 }
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func scrapeHN(minScore int) ([]feedItem, error) {
@@ -94,9 +95,11 @@ func scrapeHN(minScore int) ([]feedItem, error) {
 		hnLink := "https://news.ycombinator.com/" + scrape.Attr(commentsLink, "href")
 
 		items = append(items, feedItem{
-			Title: fmt.Sprintf("(%s) %s", domain, title),
-			GUID:  link,
-			Link:  hnLink,
+			Title:     fmt.Sprintf("(%s) %s", domain, title),
+			GUID:      link,
+			Link:      hnLink,
+			Canonical: canonicalizeURL(link),
+			Published: time.Now(),
 		})
 	}
 
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Store is everything the server keeps in its database: feeds and
+// subscriptions, items and their scores, judgements, accounts and their
+// sessions and tokens, articles, snapshots and digests.  Models are files on
+// disk, read by the classifier.
+//
+// Both backends share sqlStore's SQL, which sticks to what CockroachDB and
+// SQLite have in common; they differ in how they are opened and in their
+// migrations.
+type Store interface {
+	// Accounts, sessions and tokens.
+	countAccounts() (int, error)
+	insertAccount(a account, passwordHash string) (account, error)
+	accountByName(name string) (account, string, error)
+	accounts() ([]account, error)
+	accountsWithEmail() ([]account, error)
+	addSession(tokenHash string, accountID int64, created, expires time.Time) error
+	deleteSession(tokenHash string) error
+	accountBySession(tokenHash string, now time.Time) (account, bool, error)
+	accountByFeedToken(token string) (account, bool, error)
+	accountByID(id int64) (account, bool, error)
+	addToken(accountID int64, name, hash string, created time.Time) (int64, error)
+	listTokens(accountID int64) ([]apiToken, error)
+	revokeToken(accountID, id int64) (bool, error)
+	accountByToken(hash string, used time.Time) (account, bool, error)
+
+	// Feeds and subscriptions.
+	feeds() ([]feedSource, error)
+	feedExists(name string) (bool, error)
+	addFeed(name, link string) error
+	updateFeed(name, link string) error
+	deleteFeed(name string) error
+	listSubscriptions(accountID int64) ([]subscriptionRow, error)
+	subscription(accountID int64, feed string) (subscriptionRow, error)
+	addSubscription(accountID int64, feed string) error
+	unsubscribe(accountID int64, feed string) error
+	subscribers(feed string) ([]int64, error)
+
+	// Items and scores.
+	itemExists(guid string) (bool, error)
+	insertItem(item feedItem) (bool, error)
+	isNewStory(item feedItem) (bool, error)
+	loadItem(accountID int64, guid string) (feedItem, error)
+	itemFeeds(guid string) ([]string, error)
+	feedItemsSince(feed string, since time.Time) ([]feedItem, error)
+	addUserItem(accountID int64, item feedItem, score float64) error
+	itemAccounts(guid string) ([]int64, error)
+	unjudgedItems() ([]accountItem, error)
+	setScore(accountID int64, guid string, score float64) error
+	groupDuplicates() error
+	clusterCandidates(since time.Time) ([]feedItem, error)
+	setCluster(guid, cluster string) error
+
+	// What is offered to an account.
+	pendingCandidates(accountID int64, order candidateOrder, limit int) ([]feedItem, error)
+	recordImpressions(accountID int64, page string, items []feedItem, rankerName string) error
+	judgedItems(accountID int64, filter itemFilter, limit int) ([]judgedItem, error)
+	laterItems(accountID int64) ([]feedItem, error)
+	clusterMembers(accountID int64, cluster string) ([]feedItem, error)
+	outItems(accountID int64, since time.Time, threshold float64) ([]feedItem, error)
+
+	// Judgements.
+	judge(accountID int64, guid string, a action, onlyPending bool, page string) error
+	undoLastPage(accountID int64) (int, error)
+	recentJudgements(accountID int64, limit int) ([]judgementEvent, error)
+	judgementRecords() ([]judgementRecord, error)
+	importJudgement(accountID int64, r judgementRecord) (bool, bool, error)
+
+	// Articles and snapshots.
+	itemsWithoutArticles() ([]feedItem, error)
+	storeArticle(guid string, a article) error
+	loadArticle(guid string) (article, bool, error)
+	snapshots() ([]snapshotFile, error)
+	snapshotHash(guid string) (string, bool, error)
+	addSnapshot(guid, hash string, size int64, created time.Time) error
+	deleteSnapshots(hash string) error
+
+	// Digests.
+	lastDigest(accountID int64) (time.Time, bool, error)
+	digestItems(accountID int64, since time.Time, limit int) ([]feedItem, error)
+	recordDigest(accountID int64, items []feedItem, sent time.Time) (int64, error)
+	forgetDigest(accountID, id int64) error
+
+	// The schema, from the migrations in migrate.go.
+	schemaVersion() (int, error)
+	migrate() (int, error)
+
+	close() error
+}
+
+// sqlStore implements Store in SQL understood by both CockroachDB and
+// SQLite.  Times are passed in UTC, since SQLite compares them as text.
+// dialect names the directory of migrations its schema comes from.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+func (s *sqlStore) close() error {
+	return s.db.Close()
+}
+
+// openStore opens the database named by database, which is either a
+// PostgreSQL connection URL for CockroachDB, or sqlite: followed by the path
+// of an SQLite database file, which is created if it does not exist.  The
+// store's schema may be behind until it is migrated.
+func openStore(database string) (Store, error) {
+	if path := strings.TrimPrefix(database, "sqlite:"); path != database {
+		return openSQLite(path)
+	}
+	return openPostgres(database)
+}
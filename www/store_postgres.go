@@ -0,0 +1,15 @@
+package main
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+)
+
+// openPostgres connects to CockroachDB, or PostgreSQL, at url.
+func openPostgres(url string) (Store, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: db, dialect: "postgres"}, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"database/sql"
+	_ "modernc.org/sqlite"
+	"net/url"
+)
+
+// openSQLite opens the SQLite database at path, creating it if need be, so
+// that a single user can run the server without a database server.
+//
+// Writers wait for each other rather than failing with SQLITE_BUSY, and
+// transactions take the write lock when they begin, so that one which reads
+// and then writes cannot deadlock with another.
+func openSQLite(path string) (Store, error) {
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma": {"busy_timeout(10000)", "journal_mode(WAL)"},
+		"_txlock": {"immediate"},
+	}.Encode()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlStore{db: db, dialect: "sqlite"}, nil
+}
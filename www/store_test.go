@@ -0,0 +1,430 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestStore returns a store migrated into a temporary SQLite file, with
+// no feeds.
+func openTestStore(t *testing.T) Store {
+	t.Helper()
+
+	st, err := openStore("sqlite:" + filepath.Join(t.TempDir(), "feed.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.close() })
+
+	if _, err := st.migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	feeds, err := st.feeds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range feeds {
+		if err := st.deleteFeed(f.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return st
+}
+
+// addTestAccount adds an account which is offered items, each with its
+// Score.
+func addTestAccount(t *testing.T, st Store, name string, items ...feedItem) account {
+	t.Helper()
+
+	a, err := createAccount(st, &classifier{zeroMode: true}, name, "password1", name+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range items {
+		if _, err := st.insertItem(item); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.addUserItem(a.ID, item, item.Score); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return a
+}
+
+// judgements returns the account's action of each item it has judged.
+func judgements(t *testing.T, st Store, a account) map[string]action {
+	t.Helper()
+
+	records, err := st.judgementRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := make(map[string]action)
+	for _, r := range records {
+		if r.Account == a.Name {
+			actions[r.GUID] = r.Action
+		}
+	}
+	return actions
+}
+
+func guids(items []feedItem) []string {
+	guids := make([]string, len(items))
+	for i, item := range items {
+		guids[i] = item.GUID
+	}
+	return guids
+}
+
+func sameGUIDs(items []feedItem, want ...string) bool {
+	got := guids(items)
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestInsertItem(t *testing.T) {
+	st := openTestStore(t)
+
+	item := feedItem{GUID: "a", Feed: "f", Title: "A", Link: "https://example.com/a", Published: time.Now()}
+
+	if exists, err := st.itemExists("a"); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatal("Item exists before it was inserted")
+	}
+
+	if added, err := st.insertItem(item); err != nil {
+		t.Fatal(err)
+	} else if !added {
+		t.Fatal("Item was not added")
+	}
+
+	if exists, err := st.itemExists("a"); err != nil {
+		t.Fatal(err)
+	} else if !exists {
+		t.Fatal("Item does not exist after it was inserted")
+	}
+
+	item.Title = "Changed"
+	if added, err := st.insertItem(item); err != nil {
+		t.Fatal(err)
+	} else if added {
+		t.Fatal("Item was added twice")
+	}
+}
+
+func TestJudgeAndUndo(t *testing.T) {
+	st := openTestStore(t)
+
+	now := time.Now()
+	a := addTestAccount(t, st, "alice",
+		feedItem{GUID: "a1", Feed: "f", Title: "A", Link: "https://a.example/story", Canonical: "https://example.com/story", Published: now, Score: 0.5},
+		feedItem{GUID: "a2", Feed: "g", Title: "A", Link: "https://b.example/story", Canonical: "https://example.com/story", Published: now, Score: 0.5},
+		feedItem{GUID: "b", Feed: "f", Title: "B", Link: "https://example.com/b", Canonical: "https://example.com/b", Published: now, Score: 0.5},
+	)
+	if err := st.groupDuplicates(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Judging a story judges its copies.
+	if err := st.judge(a.ID, "a1", actionLove, false, "p1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := judgements(t, st, a); got["a1"] != actionLove || got["a2"] != actionLove || len(got) != 2 {
+		t.Fatalf("Got %v after loving a1, want a1 and a2 loved", got)
+	}
+
+	// Submitting a page only skips what is still pending.
+	for _, guid := range []string{"a1", "b"} {
+		if err := st.judge(a.ID, guid, actionSkip, true, "p2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := judgements(t, st, a); got["a1"] != actionLove || got["b"] != actionSkip {
+		t.Fatalf("Got %v after submitting, want a1 loved and b skipped", got)
+	}
+
+	// Undo takes back the latest page only.
+	if n, err := st.undoLastPage(a.ID); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Undid %d judgements of p2, want 1", n)
+	}
+	if got := judgements(t, st, a); got["a1"] != actionLove || got["b"] != "" {
+		t.Fatalf("Got %v after undoing p2, want a1 loved and b pending", got)
+	}
+
+	if n, err := st.undoLastPage(a.ID); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Errorf("Undid %d judgements of p1, want 2", n)
+	}
+	if got := judgements(t, st, a); len(got) != 0 {
+		t.Fatalf("Got %v after undoing p1, want nothing judged", got)
+	}
+}
+
+func TestJudgeImplicitly(t *testing.T) {
+	st := openTestStore(t)
+
+	now := time.Now()
+	a := addTestAccount(t, st, "alice",
+		feedItem{GUID: "loved", Feed: "f", Title: "Loved", Link: "https://example.com/loved", Published: now},
+		feedItem{GUID: "skipped", Feed: "f", Title: "Skipped", Link: "https://example.com/skipped", Published: now},
+		feedItem{GUID: "new", Feed: "f", Title: "New", Link: "https://example.com/new", Published: now},
+	)
+	if err := st.judge(a.ID, "loved", actionLove, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.judge(a.ID, "skipped", actionSkip, true, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening items only replaces what was implicit.
+	for _, guid := range []string{"loved", "skipped", "new"} {
+		if err := st.judge(a.ID, guid, actionClick, false, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := judgements(t, st, a)
+	if got["loved"] != actionLove || got["skipped"] != actionClick || got["new"] != actionClick {
+		t.Errorf("Got %v after clicking everything, want loved kept and the rest clicked", got)
+	}
+
+	// An explicit action still replaces an implicit one.
+	if err := st.judge(a.ID, "new", actionNotInterested, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := judgements(t, st, a); got["new"] != actionNotInterested {
+		t.Errorf("Got %s for new after marking it not interesting", got["new"])
+	}
+}
+
+func TestJudgeFlipped(t *testing.T) {
+	st := openTestStore(t)
+
+	a := addTestAccount(t, st, "alice",
+		feedItem{GUID: "g", Feed: "f", Title: "G", Link: "https://example.com/g", Published: time.Now()},
+	)
+	if err := st.judge(a.ID, "g", actionNotInterested, false, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flipping goes back and forth between a positive and a negative
+	// judgement, whichever the item has.
+	for _, want := range []action{actionLove, actionNotInterested, actionLove} {
+		flip, ok := judgements(t, st, a)["g"].flipped()
+		if !ok {
+			t.Fatalf("Got no flip of %s", judgements(t, st, a)["g"])
+		}
+		if err := st.judge(a.ID, "g", flip, false, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := judgements(t, st, a)["g"]; got != want {
+			t.Fatalf("Got %s after flipping, want %s", got, want)
+		}
+	}
+
+	events, err := st.recentJudgements(a.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(events) != 4 {
+		t.Errorf("Got %d judgement events after flipping three times, want 4", len(events))
+	}
+
+	if err := st.judge(a.ID, "unknown", actionLove, false, ""); err != sql.ErrNoRows {
+		t.Errorf("Got error %v judging an unknown item, want sql.ErrNoRows", err)
+	}
+}
+
+func TestPendingCandidates(t *testing.T) {
+	st := openTestStore(t)
+
+	now := time.Now()
+	a := addTestAccount(t, st, "alice",
+		feedItem{GUID: "c1", Feed: "f", Title: "C", Link: "https://example.com/c1", Published: now, Score: 0.9},
+		feedItem{GUID: "c2", Feed: "g", Title: "C", Link: "https://example.com/c2", Published: now, Score: 0.7},
+		feedItem{GUID: "d", Feed: "f", Title: "D", Link: "https://example.com/d", Published: now, Score: 0.8},
+		feedItem{GUID: "e", Feed: "f", Title: "E", Link: "https://example.com/e", Published: now, Score: 0.1},
+	)
+	for guid, cluster := range map[string]string{"c1": "c1", "c2": "c1", "d": "d", "e": "e"} {
+		if err := st.(*sqlStore).setCluster(guid, cluster); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the best of a cluster is a candidate, and counts its members.
+	candidates, err := st.pendingCandidates(a.ID, byScore, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameGUIDs(candidates, "c1", "d", "e") {
+		t.Fatalf("Got candidates %v, want c1, d, e", guids(candidates))
+	}
+	if candidates[0].ClusterSize != 2 {
+		t.Errorf("Got cluster size %d for c1, want 2", candidates[0].ClusterSize)
+	}
+
+	if candidates, err := st.pendingCandidates(a.ID, byScore, 2); err != nil {
+		t.Fatal(err)
+	} else if !sameGUIDs(candidates, "c1", "d") {
+		t.Errorf("Got candidates %v with a limit of 2, want c1, d", guids(candidates))
+	}
+
+	// Judging any member of a cluster takes the whole cluster away.
+	if err := st.judge(a.ID, "c2", actionNotInterested, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if candidates, err := st.pendingCandidates(a.ID, byScore, 10); err != nil {
+		t.Fatal(err)
+	} else if !sameGUIDs(candidates, "d", "e") {
+		t.Errorf("Got candidates %v after judging c2, want d, e", guids(candidates))
+	}
+}
+
+func TestGroupDuplicates(t *testing.T) {
+	st := openTestStore(t)
+
+	now := time.Now()
+	alice := addTestAccount(t, st, "alice",
+		feedItem{GUID: "b", Feed: "f", Title: "Story", Link: "https://f.example/story?utm_source=f", Canonical: "https://example.com/story", Published: now, Score: 0.4},
+	)
+	bob := addTestAccount(t, st, "bob",
+		feedItem{GUID: "a", Feed: "g", Title: "Story", Link: "https://g.example/story", Canonical: "https://example.com/story", Published: now, Score: 0.6},
+		feedItem{GUID: "c", Feed: "g", Title: "Other", Link: "https://example.com/other", Canonical: "https://example.com/other", Published: now, Score: 0.5},
+	)
+
+	if err := st.judge(alice.ID, "b", actionLater, false, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Grouping twice changes nothing the second time.
+	for i := 0; i < 2; i++ {
+		if err := st.groupDuplicates(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The copy with the smallest guid stands for the story, for everyone
+	// offered any copy, and keeps the judgements of the others.
+	if candidates, err := st.pendingCandidates(bob.ID, byScore, 10); err != nil {
+		t.Fatal(err)
+	} else if !sameGUIDs(candidates, "a", "c") {
+		t.Errorf("Got bob's candidates %v, want a, c", guids(candidates))
+	}
+
+	later, err := st.laterItems(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	} else if !sameGUIDs(later, "a") {
+		t.Errorf("Got alice's later items %v, want a", guids(later))
+	}
+
+	feeds, err := st.itemFeeds("a")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(feeds) != 2 {
+		t.Errorf("Got feeds %v for a, want f and g", feeds)
+	}
+}
+
+func TestDigestItems(t *testing.T) {
+	st := openTestStore(t)
+
+	now := time.Now()
+	a := addTestAccount(t, st, "alice",
+		feedItem{GUID: "best", Feed: "f", Title: "Best", Link: "https://example.com/best", Published: now, Score: 0.9},
+		feedItem{GUID: "good", Feed: "f", Title: "Good", Link: "https://example.com/good", Published: now, Score: 0.6},
+		feedItem{GUID: "judged", Feed: "f", Title: "Judged", Link: "https://example.com/judged", Published: now, Score: 0.8},
+		feedItem{GUID: "old", Feed: "f", Title: "Old", Link: "https://example.com/old", Published: now.Add(-48 * time.Hour), Score: 0.95},
+	)
+	if err := st.judge(a.ID, "judged", actionSeen, false, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	since := now.Add(-24 * time.Hour)
+
+	items, err := st.digestItems(a.ID, since, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if !sameGUIDs(items, "best") {
+		t.Fatalf("Got digest items %v with a limit of 1, want best", guids(items))
+	}
+
+	if _, err := st.recordDigest(a.ID, items, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if last, ok, err := st.lastDigest(a.ID); err != nil {
+		t.Fatal(err)
+	} else if !ok || last.Before(now.Add(-time.Second)) || last.After(now.Add(time.Second)) {
+		t.Errorf("Got last digest %v, %v, want %v", last, ok, now)
+	}
+
+	// Items are only ever sent once.
+	if items, err := st.digestItems(a.ID, since, 10); err != nil {
+		t.Fatal(err)
+	} else if !sameGUIDs(items, "good") {
+		t.Errorf("Got digest items %v after the first digest, want good", guids(items))
+	}
+}
+
+func TestJudgedItems(t *testing.T) {
+	st := openTestStore(t)
+
+	now := time.Now()
+	a := addTestAccount(t, st, "alice",
+		feedItem{GUID: "later", Feed: "f", Title: "Later", Link: "https://example.com/later", Published: now},
+		feedItem{GUID: "loved", Feed: "f", Title: "Loved", Link: "https://example.com/loved", Published: now.Add(-time.Hour)},
+		feedItem{GUID: "new", Feed: "f", Title: "New", Link: "https://example.com/new", Published: now.Add(-2 * time.Hour)},
+	)
+	if err := st.judge(a.ID, "later", actionLater, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.judge(a.ID, "loved", actionLove, false, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		filter itemFilter
+		want   []string
+	}{
+		{itemsJudged, []string{"later", "loved"}},
+		{itemsLater, []string{"later"}},
+		{itemsAll, []string{"later", "loved", "new"}},
+	} {
+		judged, err := st.judgedItems(a.ID, test.filter, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, item := range judged {
+			got = append(got, item.GUID)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("Got items %v with filter %d, want %v", got, test.filter, test.want)
+		}
+	}
+
+	if _, err := st.judgedItems(a.ID, itemFilter(-1), 10); err == nil {
+		t.Error("Listed items with an unknown filter")
+	}
+}
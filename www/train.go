@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,10 +12,76 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
-func train() error {
+// trainerClient talks to the trainer, authenticating with the shared secret
+// and, if a client certificate is configured, mutual TLS.
+type trainerClient struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func newTrainerClient(cfg trainerConfig) (*trainerClient, error) {
+	t := &trainerClient{
+		url:    strings.TrimRight(cfg.URL, "/"),
+		secret: cfg.Secret,
+		client: http.DefaultClient,
+	}
+
+	if cfg.ClientCert != "" {
+		pair, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Loading trainer.client_cert: %s", err)
+		}
+
+		config := &tls.Config{
+			Certificates: []tls.Certificate{pair},
+			MinVersion:   tls.VersionTLS12,
+		}
+
+		if cfg.CA != "" {
+			pem, err := ioutil.ReadFile(cfg.CA)
+			if err != nil {
+				return nil, fmt.Errorf("Loading trainer.ca: %s", err)
+			}
+
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificates in %s", cfg.CA)
+			}
+		}
+
+		t.client = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+
+	return t, nil
+}
+
+func (t *trainerClient) do(method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, t.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+t.secret)
+	}
+
+	return t.client.Do(req)
+}
+
+// train has the trainer train a new model and saves it as a candidate beside
+// modelPath, returning the candidate's path.  It is not used until it is
+// promoted.
+func train(cfg trainerConfig, modelPath string) (string, error) {
+	trainer, err := newTrainerClient(cfg)
+	if err != nil {
+		return "", err
+	}
+
 	var linode struct {
 		ID   string `json:"id"`
 		IPv6 string `json:"ipv6"`
@@ -27,12 +95,12 @@ func train() error {
 			"region": {"fremont-ca"},
 		})
 		if err != nil {
-			return err
+			return "", err
 		}
 		defer res.Body.Close()
 
 		if err := json.NewDecoder(res.Body).Decode(&linode); err != nil {
-			return err
+			return "", err
 		}
 	}
 
@@ -57,7 +125,7 @@ func train() error {
 		"allowed-ips", "10.0.2.1/32",
 		"endpoint", linode.IPv6+":51820",
 	).Run(); err != nil {
-		return err
+		return "", err
 	}
 
 	defer func() {
@@ -73,11 +141,12 @@ func train() error {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 	for range ticker.C {
-		res, err := http.Get("http://10.0.2.1/health")
+		res, err := trainer.do("GET", "/health")
 		if err != nil {
 			log.Printf("Got error while waiting for trainer to become healthy: %q", err)
 			continue
 		}
+		res.Body.Close()
 
 		if res.StatusCode != http.StatusOK {
 			log.Printf("/health returned status %q", res.Status)
@@ -92,20 +161,26 @@ func train() error {
 	}
 
 	{
-		res, err := http.Post("http://10.0.2.1/train", "", nil)
+		res, err := trainer.do("POST", "/train")
 		if err != nil {
-			return err
+			return "", err
 		}
 		defer res.Body.Close()
 
+		if res.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("/train returned status %q", res.Status)
+		}
+
 		if err := json.NewDecoder(res.Body).Decode(&trainResult); err != nil {
-			return err
+			return "", err
 		}
 	}
 
-	dir, err := ioutil.TempDir("", "train-result")
+	// Written beside the model rather than in the temporary directory, so
+	// that renaming them into place cannot cross filesystems.
+	dir, err := ioutil.TempDir(filepath.Dir(modelPath), "train-result")
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer os.RemoveAll(dir)
 
@@ -113,20 +188,22 @@ func train() error {
 	tempModelVecPath := filepath.Join(dir, "model.vec")
 
 	if err := ioutil.WriteFile(tempModelBinPath, trainResult.Bin, 0600); err != nil {
-		return err
+		return "", err
 	}
 
 	if err := ioutil.WriteFile(tempModelVecPath, trainResult.Vec, 0600); err != nil {
-		return err
+		return "", err
 	}
 
-	if err := os.Rename(tempModelBinPath, "./model.bin"); err != nil {
-		return err
+	candidate := candidatePath(modelPath, time.Now())
+
+	if err := os.Rename(tempModelVecPath, vecPath(candidate)); err != nil {
+		return "", err
 	}
 
-	if err := os.Rename(tempModelVecPath, "./model.vec"); err != nil {
-		return err
+	if err := os.Rename(tempModelBinPath, candidate); err != nil {
+		return "", err
 	}
 
-	return nil
+	return candidate, nil
 }